@@ -4,9 +4,23 @@ import (
 	"github.com/hewo233/hdu-se/db"
 	"github.com/hewo233/hdu-se/models"
 	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/jwt"
+	"github.com/hewo233/hdu-se/utils/mail"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"github.com/hewo233/hdu-se/utils/tools"
+	"github.com/hewo233/hdu-se/utils/webhook"
 )
 
 func AllInit() {
 	db.Init()
+	db.PromoteAdmins(consts.AdminEmailsFile)
 	models.SetCozeToken(consts.CozeTokenFile)
+	coze.InitCassette(consts.CassetteConfigFile)
+	coze.InitClient(models.CozeToken)
+	provider.InitMock(consts.MockConfigFile)
+	jwt.InitKeys(consts.JWTKeysDir, provider.MockEnabled())
+	mail.InitMailer(consts.MailConfigFile)
+	tools.RegisterBuiltins()
+	webhook.InitConfig(consts.WebhookConfigFile)
 }
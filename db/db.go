@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hewo233/hdu-se/models"
 	"github.com/hewo233/hdu-se/shared/consts"
@@ -9,20 +10,147 @@ import (
 	"gorm.io/gorm"
 	"log"
 	"os"
+	"strings"
 )
 
 func UpdateDB() {
+	hadVerification := DB.Table(consts.UserTable).Migrator().HasColumn(&models.User{}, "EmailVerified")
 	err := DB.Table(consts.UserTable).AutoMigrate(&models.User{})
 	if err != nil {
 		log.Fatal(err)
 	}
+	// users registered before verification existed keep their access
+	if !hadVerification {
+		err = DB.Table(consts.UserTable).Where("1 = 1").Update("email_verified", true).Error
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the conversation id became unique, the plain index it replaces goes away
+	if DB.Table(consts.ConversationTable).Migrator().HasIndex(&models.Conversation{}, "idx_conversations_conversation_id") {
+		err = DB.Table(consts.ConversationTable).Migrator().DropIndex(&models.Conversation{}, "idx_conversations_conversation_id")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	err = DB.Table(consts.ConversationTable).AutoMigrate(&models.Conversation{})
 	if err != nil {
 		log.Fatal(err)
 	}
+	// conversations created before the timestamps existed
+	err = DB.Exec("UPDATE " + consts.ConversationTable + " SET created_at = NOW(), updated_at = NOW(), last_message_at = NOW() WHERE last_message_at IS NULL").Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.MessageTable).AutoMigrate(&models.Message{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.UsageTable).AutoMigrate(&models.Usage{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.QuotaTable).AutoMigrate(&models.Quota{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.BotTable).AutoMigrate(&models.Bot{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	seedDefaultBot()
+	err = DB.Table(consts.ChatTable).AutoMigrate(&models.Chat{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.FileTable).AutoMigrate(&models.File{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// a tool call is stored once per chat, duplicates of calls that ran twice go away
+	if DB.Table(consts.ToolCallTable).Migrator().HasTable(&models.ToolCall{}) &&
+		!DB.Table(consts.ToolCallTable).Migrator().HasIndex(&models.ToolCall{}, "idx_tool_calls_chat_id_tool_call_id") {
+		err = DB.Exec("DELETE FROM " + consts.ToolCallTable + " a USING " + consts.ToolCallTable + " b WHERE a.chat_id = b.chat_id AND a.tool_call_id = b.tool_call_id AND a.id > b.id").Error
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = DB.Table(consts.ToolCallTable).AutoMigrate(&models.ToolCall{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.WebhookTable).AutoMigrate(&models.Webhook{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.DeliveryTable).AutoMigrate(&models.WebhookDelivery{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.AccessTokenTable).AutoMigrate(&models.AccessToken{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.RefreshTokenTable).AutoMigrate(&models.RefreshToken{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.PasswordResetTable).AutoMigrate(&models.PasswordReset{})
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Println("\033[32mAutoMigrate success\033[0m")
 }
 
+// seedDefaultBot registers consts.BotID and assigns it to conversations created before bots existed
+func seedDefaultBot() {
+	var count int64
+	if err := DB.Table(consts.BotTable).Count(&count).Error; err != nil {
+		log.Fatal(err)
+	}
+	if count == 0 {
+		bot := models.Bot{
+			BotID:    consts.BotID,
+			Name:     "Default",
+			Enabled:  true,
+			Provider: consts.ProviderCoze,
+		}
+		if err := DB.Table(consts.BotTable).Create(&bot).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err := DB.Table(consts.ConversationTable).Where("bot_id = ''").Update("bot_id", consts.BotID).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// PromoteAdmins gives the admin role to the users listed in the file, one email
+// per line, so the first admin needs no database access
+func PromoteAdmins(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to read admin list:", err)
+		}
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		email := strings.TrimSpace(line)
+		if email == "" || strings.HasPrefix(email, "#") {
+			continue
+		}
+		result := DB.Table(consts.UserTable).Where("email = ?", email).Update("role", consts.RoleAdmin)
+		if result.Error != nil {
+			log.Fatal(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			log.Println("Admin not registered yet:", email)
+		}
+	}
+}
+
 func ConnectDB() {
 
 	if err := godotenv.Load(consts.DBEnvFile); err != nil {
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strconv"
+)
+
+type adminListUsersRequest struct {
+	Role     string `form:"role"`
+	Disabled string `form:"disabled" binding:"omitempty,oneof=true false"`
+	Query    string `form:"q"`
+	Offset   int    `form:"offset" binding:"omitempty,min=0"`
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type adminListUsersResponse struct {
+	Users []models.User `json:"users"`
+	Total int64         `json:"total"`
+}
+
+// AdminListUsers GET /admin/user
+func AdminListUsers(c *gin.Context) {
+	var req adminListUsersRequest
+	if err := c.ShouldBindQuery(&req); err != nil || (req.Role != "" && !consts.ValidRole(req.Role)) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = consts.DefaultPageSize
+	}
+
+	tx := db.DB.Table(consts.UserTable)
+	if req.Role != "" {
+		tx = tx.Where("role = ?", req.Role)
+	}
+	if req.Disabled != "" {
+		tx = tx.Where("disabled = ?", req.Disabled == "true")
+	}
+	if req.Query != "" {
+		pattern := likeContains(req.Query)
+		tx = tx.Where("username ILIKE ? ESCAPE '\\' OR email ILIKE ? ESCAPE '\\'", pattern, pattern)
+	}
+
+	response := adminListUsersResponse{
+		Users: []models.User{},
+	}
+	if err := tx.Count(&response.Total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50110,
+			Result: "Failed to retrieve users from database",
+		})
+		return
+	}
+	if err := tx.Order("id").Offset(req.Offset).Limit(req.Limit).Find(&response.Users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50110,
+			Result: "Failed to retrieve users from database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: response,
+	})
+}
+
+// adminGetUser loads a user by id for the admin API
+func adminGetUser(c *gin.Context) (*models.User, error) {
+	user := models.UserNew()
+	result := db.DB.Table(consts.UserTable).Where("id = ?", c.Param("id")).First(user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40405,
+				Result: "User not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50110,
+				Result: "Failed to query user",
+			})
+		}
+		return nil, result.Error
+	}
+	return user, nil
+}
+
+// adminGetOtherUser is adminGetUser for changes, admins can not lock themselves out
+func adminGetOtherUser(c *gin.Context) (*models.User, error) {
+	user, err := adminGetUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.GetString("id") == strconv.Itoa(int(user.ID)) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40012,
+			Result: "You can not change your own account",
+		})
+		return nil, errors.New("admin changes own account")
+	}
+	return user, nil
+}
+
+type adminGetUserResponse struct {
+	User    models.User   `json:"user"`
+	Quota   *models.Quota `json:"quota"`
+	Daily   *usageSummary `json:"daily"`
+	Monthly *usageSummary `json:"monthly"`
+}
+
+// AdminGetUser GET /admin/user/:id, the user with quota and token usage
+func AdminGetUser(c *gin.Context) {
+	user, err := adminGetUser(c)
+	if err != nil {
+		return
+	}
+
+	quota, err := getUserQuota(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50030,
+			Result: "Failed to query token usage",
+		})
+		return
+	}
+	daily, monthly, err := getUserUsage(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50030,
+			Result: "Failed to query token usage",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code: 20000,
+		Result: adminGetUserResponse{
+			User:    *user,
+			Quota:   quota,
+			Daily:   daily,
+			Monthly: monthly,
+		},
+	})
+}
+
+type adminSetRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// AdminSetUserRole PUT /admin/user/:id/role, promotes or demotes a user
+func AdminSetUserRole(c *gin.Context) {
+	var req adminSetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !consts.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	user, err := adminGetOtherUser(c)
+	if err != nil {
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.UserTable).Where("id = ?", user.ID).Update("role", req.Role).Error; err != nil {
+			return err
+		}
+		// access tokens carry the old role, the next refresh picks up the new one
+		return tx.Table(consts.AccessTokenTable).Where("user_id = ?", user.ID).Update("revoked", true).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50111,
+			Result: "Failed to update user",
+		})
+		return
+	}
+	user.Role = req.Role
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: user,
+	})
+}
+
+type adminSetDisabledRequest struct {
+	Disabled *bool `json:"disabled" binding:"required"`
+}
+
+// AdminSetUserDisabled PUT /admin/user/:id/disabled, disabling ends all sessions of the user
+func AdminSetUserDisabled(c *gin.Context) {
+	var req adminSetDisabledRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	user, err := adminGetOtherUser(c)
+	if err != nil {
+		return
+	}
+
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", user.ID).Update("disabled", *req.Disabled).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50111,
+			Result: "Failed to update user",
+		})
+		return
+	}
+	user.Disabled = *req.Disabled
+	if user.Disabled {
+		if err := revokeTokens(user.ID, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50092,
+				Result: "Failed to revoke tokens",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: user,
+	})
+}
+
+type adminSetQuotaRequest struct {
+	DailyTokens   *int64 `json:"daily_tokens" binding:"required,min=0"`
+	MonthlyTokens *int64 `json:"monthly_tokens" binding:"required,min=0"`
+}
+
+// AdminSetUserQuota PUT /admin/user/:id/quota, 0 means unlimited
+func AdminSetUserQuota(c *gin.Context) {
+	var req adminSetQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	user, err := adminGetUser(c)
+	if err != nil {
+		return
+	}
+
+	quota := models.Quota{
+		UserID:        user.ID,
+		DailyTokens:   *req.DailyTokens,
+		MonthlyTokens: *req.MonthlyTokens,
+	}
+	result := db.DB.Table(consts.QuotaTable).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"daily_tokens", "monthly_tokens"}),
+		}).
+		Create(&quota)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50112,
+			Result: "Failed to save quota",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: quota,
+	})
+}
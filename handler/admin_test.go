@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/middleware"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"net/http"
+	"testing"
+)
+
+// setupAdminTest returns the admin routes behind the permission checks,
+// every request is made with the given role
+func setupAdminTest(t *testing.T, role string) *gin.Engine {
+	t.Helper()
+	setupTestDB(t)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("id", "1")
+		c.Set("role", role)
+	})
+	r.GET("/admin/user", middleware.RequirePermission(consts.PermUserRead), AdminListUsers)
+	r.PUT("/admin/user/:id/role", middleware.RequirePermission(consts.PermUserManage), AdminSetUserRole)
+	r.POST("/admin/bot", middleware.RequirePermission(consts.PermBotManage), AdminCreateBot)
+	r.PUT("/admin/bot/:id", middleware.RequirePermission(consts.PermBotManage), AdminUpdateBot)
+	return r
+}
+
+func TestAdminListUsersIsAdminOnly(t *testing.T) {
+	for role, want := range map[string]int{
+		consts.RoleStudent: http.StatusForbidden,
+		consts.RoleTeacher: http.StatusForbidden,
+		consts.RoleAdmin:   http.StatusOK,
+	} {
+		role, want := role, want
+		t.Run(role, func(t *testing.T) {
+			r := setupAdminTest(t, role)
+			if w := doJSON(r, http.MethodGet, "/admin/user", ""); w.Code != want {
+				t.Errorf("got %d, want %d: %s", w.Code, want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminRejectsUnknownRoles(t *testing.T) {
+	r := setupAdminTest(t, consts.RoleAdmin)
+	user := models.User{Username: "bob", Email: "bob@example.com", Password: "x", Role: consts.RoleStudent}
+	if err := db.DB.Table(consts.UserTable).Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	bot := models.Bot{BotID: "b1", Name: "Bot", Enabled: true, Provider: consts.ProviderMock}
+	if err := db.DB.Table(consts.BotTable).Create(&bot).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/admin/user?role=guest", ""},
+		{http.MethodPut, "/admin/user/2/role", `{"role":"guest"}`},
+		{http.MethodPost, "/admin/bot", `{"bot_id":"b2","name":"Bot","provider":"mock","allowed_roles":["student","guest"]}`},
+		{http.MethodPut, "/admin/bot/1", `{"allowed_roles":["guest"]}`},
+	} {
+		if w := doJSON(r, tc.method, tc.path, tc.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: got %d: %s", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", user.ID).First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != consts.RoleStudent {
+		t.Errorf("role changed to %q", user.Role)
+	}
+	var count int64
+	db.DB.Table(consts.BotTable).Count(&count)
+	if count != 1 {
+		t.Errorf("got %d bots", count)
+	}
+
+	w := doJSON(r, http.MethodPost, "/admin/bot", `{"bot_id":"b2","name":"Bot","provider":"mock","allowed_roles":["teacher"]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("known role: got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/jwt"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+}
+
+// issueTokens creates an access token and a refresh token in the session
+func issueTokens(user *models.User, sessionID string) (*tokenPair, error) {
+	userID := user.ID
+	accessToken, claims, err := jwt.GenerateJWT(strconv.Itoa(int(userID)), sessionID, user.Role, consts.User)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := jwt.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// expired rows are useless, drop them on the way
+		now := time.Now()
+		if err := tx.Table(consts.AccessTokenTable).Where("user_id = ? AND expires_at < ?", userID, now).Delete(&models.AccessToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(consts.RefreshTokenTable).Where("user_id = ? AND expires_at < ?", userID, now).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+
+		access := models.AccessToken{
+			JTI:       claims.Id,
+			UserID:    userID,
+			SessionID: sessionID,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		}
+		if err := tx.Table(consts.AccessTokenTable).Create(&access).Error; err != nil {
+			return err
+		}
+		refresh := models.RefreshToken{
+			UserID:    userID,
+			SessionID: sessionID,
+			TokenHash: jwt.HashToken(refreshToken),
+			ExpiresAt: now.Add(consts.RefreshTokenTTL),
+		}
+		return tx.Table(consts.RefreshTokenTable).Create(&refresh).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(consts.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// revokeTokens revokes the access and refresh tokens of one session of the
+// user, or of all sessions when sessionID is empty
+func revokeTokens(userID uint, sessionID string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		access := tx.Table(consts.AccessTokenTable).Where("user_id = ?", userID)
+		refresh := tx.Table(consts.RefreshTokenTable).Where("user_id = ?", userID)
+		if sessionID != "" {
+			access = access.Where("session_id = ?", sessionID)
+			refresh = refresh.Where("session_id = ?", sessionID)
+		}
+		if err := access.Update("revoked", true).Error; err != nil {
+			return err
+		}
+		return refresh.Update("revoked", true).Error
+	})
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshToken POST /auth/refresh, trade a refresh token for a new pair
+func RefreshToken(c *gin.Context) {
+	var req refreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	stored := models.NewRefreshToken()
+	result := db.DB.Table(consts.RefreshTokenTable).Where("token_hash = ?", jwt.HashToken(req.RefreshToken)).First(stored)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, models.Report{
+				Code:   40160,
+				Result: "Invalid refresh token",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50090,
+				Result: "Failed to query refresh token",
+			})
+		}
+		return
+	}
+
+	if stored.Revoked || stored.UsedAt != nil {
+		// a used token coming back means it was stolen, end the session
+		log.Println("Refresh token reused, revoking session", stored.SessionID)
+		if err := revokeTokens(stored.UserID, stored.SessionID); err != nil {
+			log.Println("Failed to revoke session:", err)
+		}
+		c.JSON(http.StatusUnauthorized, models.Report{
+			Code:   40161,
+			Result: "Refresh token revoked",
+		})
+		return
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, models.Report{
+			Code:   40162,
+			Result: "Refresh token expired",
+		})
+		return
+	}
+
+	// only one of two concurrent refreshes wins the token
+	result = db.DB.Table(consts.RefreshTokenTable).
+		Where("id = ? AND used_at IS NULL", stored.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50091,
+			Result: "Failed to rotate refresh token",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusUnauthorized, models.Report{
+			Code:   40161,
+			Result: "Refresh token revoked",
+		})
+		return
+	}
+
+	// the role may have changed since the session started
+	user := models.UserNew()
+	result = db.DB.Table(consts.UserTable).Where("id = ?", stored.UserID).First(user)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to query user",
+		})
+		return
+	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, models.Report{
+			Code:   40303,
+			Result: "User is disabled",
+		})
+		return
+	}
+
+	tokens, err := issueTokens(user, stored.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50005,
+			Result: "failed to generate jwt token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: tokens,
+	})
+}
+
+type logoutRequest struct {
+	Everywhere bool `json:"everywhere"`
+}
+
+// Logout POST /auth/logout, ends the current session or with everywhere all sessions of the user
+func Logout(c *gin.Context) {
+	var req logoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.Report{
+				Code:   40000,
+				Result: "Invalid request parameters",
+			})
+			return
+		}
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	sessionID := c.GetString("sid")
+	if req.Everywhere {
+		sessionID = ""
+	}
+	if err := revokeTokens(userID, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50092,
+			Result: "Failed to revoke tokens",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Logged out",
+	})
+}
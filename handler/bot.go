@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// GetUsableBot loads the bot and checks that the user may chat with it
+func GetUsableBot(c *gin.Context, botID string) (*models.Bot, error) {
+	bot := models.NewBot()
+	result := db.DB.Table(consts.BotTable).Where("bot_id = ?", botID).First(bot)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40401,
+				Result: "Bot not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50040,
+				Result: "Failed to query bot",
+			})
+		}
+		c.Abort()
+		return nil, result.Error
+	}
+
+	if !bot.Enabled {
+		c.JSON(http.StatusForbidden, models.Report{
+			Code:   40301,
+			Result: "Bot is disabled",
+		})
+		c.Abort()
+		return nil, errors.New("bot is disabled")
+	}
+
+	if !bot.AllowsRole(c.GetString("role")) {
+		c.JSON(http.StatusForbidden, models.Report{
+			Code:   40302,
+			Result: "Bot is not available for your role",
+		})
+		c.Abort()
+		return nil, errors.New("bot is not available for the role")
+	}
+
+	return bot, nil
+}
+
+type listBotsResponse struct {
+	Bots []models.Bot `json:"bots"`
+}
+
+// ListBots GET /coze/bot, bots the user can start a conversation with
+func ListBots(c *gin.Context) {
+	bots := []models.Bot{}
+	result := db.DB.Table(consts.BotTable).Where("enabled = ?", true).Order("id").Find(&bots)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50041,
+			Result: "Failed to retrieve bots from database",
+		})
+		return
+	}
+
+	usable := []models.Bot{}
+	for _, bot := range bots {
+		if bot.AllowsRole(c.GetString("role")) {
+			// where a self hosted model runs is none of the users' business
+			bot.BaseURL = ""
+			usable = append(usable, bot)
+		}
+	}
+
+	c.JSON(http.StatusOK, listBotsResponse{
+		Bots: usable,
+	})
+}
+
+// AdminListBots GET /admin/bot
+func AdminListBots(c *gin.Context) {
+	bots := []models.Bot{}
+	result := db.DB.Table(consts.BotTable).Order("id").Find(&bots)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50041,
+			Result: "Failed to retrieve bots from database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: listBotsResponse{Bots: bots},
+	})
+}
+
+type createBotRequest struct {
+	BotID        string   `json:"bot_id" binding:"required"`
+	Name         string   `json:"name" binding:"required"`
+	Description  string   `json:"description"`
+	Enabled      *bool    `json:"enabled"`
+	AllowedRoles []string `json:"allowed_roles"`
+	Provider     string   `json:"provider" binding:"omitempty,oneof=coze openai mock"`
+	BaseURL      string   `json:"base_url" binding:"omitempty,url"`
+	Model        string   `json:"model"`
+	APIKey       string   `json:"api_key"`
+}
+
+// checkBotProvider rejects provider settings no provider can be built from
+func checkBotProvider(c *gin.Context, bot *models.Bot) error {
+	if _, err := providerFor(bot); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40011,
+			Result: "Invalid provider settings: " + err.Error(),
+		})
+		return err
+	}
+	return nil
+}
+
+// validRoles reports whether every role is one of consts.RolePermissions
+func validRoles(roles []string) bool {
+	for _, role := range roles {
+		if !consts.ValidRole(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// AdminCreateBot POST /admin/bot
+func AdminCreateBot(c *gin.Context) {
+	var req createBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !validRoles(req.AllowedRoles) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	var count int64
+	if err := db.DB.Table(consts.BotTable).Where("bot_id = ?", req.BotID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50040,
+			Result: "Failed to query bot",
+		})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40010,
+			Result: "Bot with this bot_id already exists",
+		})
+		return
+	}
+
+	bot := models.Bot{
+		BotID:        req.BotID,
+		Name:         req.Name,
+		Description:  req.Description,
+		Enabled:      req.Enabled == nil || *req.Enabled,
+		AllowedRoles: req.AllowedRoles,
+		Provider:     req.Provider,
+		BaseURL:      req.BaseURL,
+		Model:        req.Model,
+		APIKey:       req.APIKey,
+	}
+	if bot.Provider == "" {
+		bot.Provider = consts.ProviderCoze
+	}
+	if err := checkBotProvider(c, &bot); err != nil {
+		return
+	}
+	if err := db.DB.Table(consts.BotTable).Create(&bot).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50042,
+			Result: "Failed to save bot to database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: bot,
+	})
+}
+
+type updateBotRequest struct {
+	Name         *string   `json:"name"`
+	Description  *string   `json:"description"`
+	Enabled      *bool     `json:"enabled"`
+	AllowedRoles *[]string `json:"allowed_roles"`
+	Provider     *string   `json:"provider" binding:"omitempty,oneof=coze openai mock"`
+	BaseURL      *string   `json:"base_url" binding:"omitempty,url"`
+	Model        *string   `json:"model"`
+	APIKey       *string   `json:"api_key"`
+}
+
+// adminGetBot loads a bot by its local id for the admin API
+func adminGetBot(c *gin.Context) (*models.Bot, error) {
+	bot := models.NewBot()
+	result := db.DB.Table(consts.BotTable).Where("id = ?", c.Param("id")).First(bot)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40401,
+				Result: "Bot not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50040,
+				Result: "Failed to query bot",
+			})
+		}
+		return nil, result.Error
+	}
+	return bot, nil
+}
+
+// AdminUpdateBot PUT /admin/bot/:id
+func AdminUpdateBot(c *gin.Context) {
+	var req updateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.AllowedRoles != nil && !validRoles(*req.AllowedRoles)) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	bot, err := adminGetBot(c)
+	if err != nil {
+		return
+	}
+
+	if req.Name != nil {
+		bot.Name = *req.Name
+	}
+	if req.Description != nil {
+		bot.Description = *req.Description
+	}
+	if req.Enabled != nil {
+		bot.Enabled = *req.Enabled
+	}
+	if req.AllowedRoles != nil {
+		bot.AllowedRoles = *req.AllowedRoles
+	}
+	if req.Provider != nil {
+		bot.Provider = *req.Provider
+	}
+	if req.BaseURL != nil {
+		bot.BaseURL = *req.BaseURL
+	}
+	if req.Model != nil {
+		bot.Model = *req.Model
+	}
+	if req.APIKey != nil {
+		bot.APIKey = *req.APIKey
+	}
+	if err := checkBotProvider(c, bot); err != nil {
+		return
+	}
+
+	if err := db.DB.Table(consts.BotTable).Save(bot).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50042,
+			Result: "Failed to save bot to database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: bot,
+	})
+}
+
+// AdminDeleteBot DELETE /admin/bot/:id, bots still used by conversations can only be disabled
+func AdminDeleteBot(c *gin.Context) {
+	bot, err := adminGetBot(c)
+	if err != nil {
+		return
+	}
+
+	var count int64
+	if err := db.DB.Table(consts.ConversationTable).Where("bot_id = ?", bot.BotID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to retrieve conversations from database",
+		})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, models.Report{
+			Code:   40910,
+			Result: "Bot is used by conversations, disable it instead",
+		})
+		return
+	}
+
+	if err := db.DB.Table(consts.BotTable).Delete(bot).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50043,
+			Result: "Failed to delete bot",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Bot deleted",
+	})
+}
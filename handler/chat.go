@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"time"
+)
+
+// saveChatStatus records the latest known status of a chat and notifies
+// the webhooks of the user when the status changed
+func saveChatStatus(userID uint, chat *coze.Chat) {
+	if chat.ID == "" {
+		return
+	}
+	row := models.Chat{
+		ChatID:         chat.ID,
+		ConversationID: chat.ConversationID,
+		UserID:         userID,
+		Status:         chat.Status,
+	}
+	result := db.DB.Table(consts.ChatTable).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "chat_id"}}, DoNothing: true}).
+		Create(&row)
+	if result.Error != nil {
+		log.Println("Failed to save chat status:", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		// only one of several concurrent pollers sees the change
+		result = db.DB.Table(consts.ChatTable).
+			Where("chat_id = ? AND status <> ?", chat.ID, chat.Status).
+			Updates(map[string]interface{}{"status": chat.Status, "updated_at": time.Now()})
+		if result.Error != nil {
+			log.Println("Failed to save chat status:", result.Error)
+			return
+		}
+	}
+
+	if result.RowsAffected > 0 {
+		notifyChatStatus(userID, chat)
+	}
+}
+
+func isChatFinished(status string) bool {
+	switch status {
+	case coze.ChatStatusCompleted, coze.ChatStatusFailed, coze.ChatStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// watchChat follows a chat nobody waits for until it finishes, so webhooks
+// fire and usage counts against the quota without the client polling
+func watchChat(backend provider.Provider, userID uint, conversationID string, chatID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), consts.MaxChatWaitTimeout)
+	defer cancel()
+
+	chat, err := pollChat(ctx, backend, userID, conversationID, chatID)
+	if err != nil {
+		log.Println("Failed to watch chat", chatID, ":", err)
+		return
+	}
+	saveChatStatus(userID, chat)
+	if chat.Status == coze.ChatStatusCompleted {
+		syncChatMessages(ctx, backend, chat)
+		recordUsage(userID, chat)
+	}
+}
+
+// cancelAbandonedChat cancels a chat upstream after the client went away,
+// ctx of the request is already done so a fresh one is used
+func cancelAbandonedChat(backend provider.Provider, userID uint, conversationID string, chatID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chat, err := provider.CancelChat(ctx, backend, conversationID, chatID)
+	if err != nil {
+		log.Println("Failed to cancel abandoned chat", chatID, ":", err)
+		return
+	}
+	saveChatStatus(userID, chat)
+}
+
+type cancelChatRequest struct {
+	ConversationID string `json:"conversation_id" binding:"required"`
+	ChatID         string `json:"chat_id" binding:"required"`
+}
+
+// CancelChat POST /coze/chat/cancel
+func CancelChat(c *gin.Context) {
+	var req cancelChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters" + err.Error(),
+		})
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	conversation, err := GetUserConversation(c, userID, req.ConversationID)
+	if err != nil {
+		return
+	}
+	backend, err := GetConversationProvider(c, conversation)
+	if err != nil {
+		return
+	}
+
+	var count int64
+	result := db.DB.Table(consts.ChatTable).
+		Where("chat_id = ? AND conversation_id <> ?", req.ChatID, req.ConversationID).
+		Count(&count)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50050,
+			Result: "Failed to query chat",
+		})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusNotFound, models.Report{
+			Code:   40402,
+			Result: "Chat not found in this conversation",
+		})
+		return
+	}
+
+	chat, err := provider.CancelChat(c.Request.Context(), backend, req.ConversationID, req.ChatID)
+	if err != nil {
+		reportUpstreamError(c, err)
+		return
+	}
+	saveChatStatus(userID, chat)
+
+	c.JSON(http.StatusOK, createChatResponse{
+		ConversationID: chat.ConversationID,
+		ChatID:         chat.ID,
+		Status:         chat.Status,
+	})
+}
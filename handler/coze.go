@@ -1,17 +1,22 @@
 package handler
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/hewo233/hdu-se/db"
 	"github.com/hewo233/hdu-se/models"
 	"github.com/hewo233/hdu-se/shared/consts"
-	"io"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"gorm.io/gorm"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func GetUserId(c *gin.Context) (uint, error) {
@@ -48,21 +53,74 @@ func GetUserId(c *gin.Context) (uint, error) {
 	return uint(userID), nil
 }
 
+// GetUserConversation loads the conversation and checks that it belongs to the user
+func GetUserConversation(c *gin.Context, userID uint, conversationID string) (*models.Conversation, error) {
+	conversation := models.NewConversation()
+	result := db.DB.Table(consts.ConversationTable).Where("conversation_id = ?", conversationID).First(conversation)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40400,
+				Result: "Conversation not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50010,
+				Result: "Failed to query conversation",
+			})
+		}
+		c.Abort()
+		return nil, result.Error
+	}
+
+	if conversation.UserID != userID {
+		c.JSON(http.StatusForbidden, models.Report{
+			Code:   40300,
+			Result: "Forbidden: conversation belongs to another user",
+		})
+		c.Abort()
+		return nil, errors.New("conversation belongs to another user")
+	}
+
+	return conversation, nil
+}
+
+// reportUpstreamError maps an error from the bot provider to a Report
+func reportUpstreamError(c *gin.Context, err error) {
+	if errors.Is(err, provider.ErrUnsupported) {
+		c.JSON(http.StatusNotImplemented, models.Report{
+			Code:   50100,
+			Result: "Not supported by the provider of this bot",
+		})
+		return
+	}
+	var cozeErr *coze.Error
+	if errors.As(err, &cozeErr) {
+		log.Println("Upstream API error:", cozeErr)
+		c.JSON(http.StatusBadGateway, models.Report{
+			Code:   cozeErr.Code,
+			Result: cozeErr.Msg,
+		})
+		return
+	}
+	log.Println("Failed to call upstream API:", err)
+	c.JSON(http.StatusInternalServerError, models.Report{
+		Code:   50002,
+		Result: "Failed to call external API",
+	})
+}
+
 type createConversationRequest struct {
-	Name string `json:"name" binding:"omitempty"` // 允许空值
+	Name            string            `json:"name" binding:"omitempty"` // 允许空值
+	BotID           string            `json:"bot_id" binding:"omitempty"`
+	CustomVariables map[string]string `json:"custom_variables" binding:"omitempty,max=16,dive,keys,max=64,endkeys,max=512"`
+	MetaData        map[string]string `json:"meta_data" binding:"omitempty,max=16,dive,keys,max=64,endkeys,max=512"`
 }
 type createConversationResponse struct {
 	ConversationID string `json:"conversation_id"`
 }
 
 func CreateConversation(c *gin.Context) {
-	type cozeAPIResponse struct {
-		Code int `json:"code"`
-		Data struct {
-			ID string `json:"id"`
-		} `json:"data"`
-		Msg string `json:"msg"`
-	}
 	var req createConversationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.Report{
@@ -72,75 +130,43 @@ func CreateConversation(c *gin.Context) {
 		return
 	}
 
-	type cozeReqPayload struct {
-		BotID string `json:"bot_id"`
-		Name  string `json:"name"`
-	}
-
-	cozeReq := &cozeReqPayload{
-		BotID: consts.BotID,
-		Name:  req.Name,
-	}
-
-	cozeReqBody, err := json.Marshal(cozeReq)
+	userID, err := GetUserId(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50001,
-			Result: "Failed to create request body",
-		})
 		return
 	}
 
-	client := &http.Client{}
-	apiURL := consts.CreateConversationURL
-
-	proxyReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(cozeReqBody))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
-		return
+	if req.BotID == "" {
+		req.BotID = consts.BotID
 	}
-
-	proxyReq.Header.Set("Authorization", "Bearer "+models.CozeToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(proxyReq)
+	bot, err := GetUsableBot(c, req.BotID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50002,
-			Result: "Failed to call external API" + err.Error(),
-		})
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	backend, err := GetBotProvider(c, bot)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read response"})
-		return
-	}
-
-	var cozeResp cozeAPIResponse
-	if err := json.Unmarshal(body, &cozeResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to parse external response"})
-		return
-	}
-
-	if cozeResp.Code != 0 {
-		c.JSON(http.StatusBadGateway, gin.H{"error": cozeResp.Msg, "code": cozeResp.Code})
 		return
 	}
 
-	// write into database
-
-	userID, err := GetUserId(c)
+	cozeConversation, err := backend.CreateConversation(c.Request.Context(), &coze.CreateConversationRequest{
+		BotID:    req.BotID,
+		Name:     req.Name,
+		MetaData: req.MetaData,
+	})
 	if err != nil {
+		reportUpstreamError(c, err)
 		return
 	}
 
+	// write into database
 	conversation := models.Conversation{
-		ConversationID: cozeResp.Data.ID,
-		UserID:         userID,
-		Name:           req.Name,
+		ConversationID:  cozeConversation.ID,
+		UserID:          userID,
+		Name:            req.Name,
+		BotID:           req.BotID,
+		CustomVariables: req.CustomVariables,
+		MetaData:        req.MetaData,
+		SectionID:       cozeConversation.LastSectionID,
+		LastMessageAt:   time.Now(),
 	}
 	result := db.DB.Table(consts.ConversationTable).Create(&conversation)
 	if result.Error != nil {
@@ -153,21 +179,92 @@ func CreateConversation(c *gin.Context) {
 
 	// 返回给客户端
 	c.JSON(http.StatusOK, createConversationResponse{
-		ConversationID: cozeResp.Data.ID,
+		ConversationID: cozeConversation.ID,
 	})
 }
 
+type listConversationsRequest struct {
+	Archived string `form:"archived" binding:"omitempty,oneof=true false all"`
+	Query    string `form:"q"`
+	Cursor   string `form:"cursor"`
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
 type listConversationsResponse struct {
 	Conversations []models.Conversation `json:"conversations"`
+	NextCursor    string                `json:"next_cursor"`
+}
+
+// encodeConversationCursor points after the conversation in the last activity order
+func encodeConversationCursor(conversation *models.Conversation) string {
+	raw := fmt.Sprintf("%d:%d", conversation.LastMessageAt.UnixMicro(), conversation.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
 }
 
+func decodeConversationCursor(cursor string) (time.Time, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, errors.New("malformed cursor")
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.UnixMicro(micros), uint(id), nil
+}
+
+// ListConversations GET /coze/conversation, most recently active first
 func ListConversations(c *gin.Context) {
+	var req listConversationsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = consts.DefaultPageSize
+	}
+
 	userID, err := GetUserId(c)
 	if err != nil {
 		return
 	}
 	conversations := []models.Conversation{}
-	result := db.DB.Table(consts.ConversationTable).Where("user_id = ?", userID).Find(&conversations)
+	tx := db.DB.Table(consts.ConversationTable).Where("user_id = ?", userID)
+	switch req.Archived {
+	case "all":
+	case "true":
+		tx = tx.Where("archived = ?", true)
+	default:
+		tx = tx.Where("archived = ?", false)
+	}
+	if req.Query != "" {
+		tx = tx.Where("name ILIKE ? ESCAPE '\\'", likeContains(req.Query))
+	}
+	if req.Cursor != "" {
+		lastMessageAt, id, err := decodeConversationCursor(req.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Report{
+				Code:   40003,
+				Result: "Invalid cursor",
+			})
+			return
+		}
+		tx = tx.Where("(last_message_at, id) < (?, ?)", lastMessageAt, id)
+	}
+
+	// one extra row tells whether there is a next page
+	result := tx.Order("last_message_at DESC, id DESC").Limit(req.Limit + 1).Find(&conversations)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, models.Report{
 			Code:   50003,
@@ -176,145 +273,261 @@ func ListConversations(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, listConversationsResponse{
+	response := listConversationsResponse{
 		Conversations: conversations,
-	})
-}
+	}
+	if len(conversations) > req.Limit {
+		response.Conversations = conversations[:req.Limit]
+		response.NextCursor = encodeConversationCursor(&response.Conversations[req.Limit-1])
+	}
 
-type createChatRequest struct {
-	ConversationID string `json:"conversation_id" binding:"required"`
-	Message        string `json:"message" binding:"required"`
+	c.JSON(http.StatusOK, response)
 }
 
-type createChatResponse struct {
-	ConversationID string `json:"conversation_id"`
-	ChatID         string `json:"chat_id"`
-	Status         string `json:"status"`
+type updateConversationRequest struct {
+	Name            *string            `json:"name"`
+	Archived        *bool              `json:"archived"`
+	CustomVariables *map[string]string `json:"custom_variables" binding:"omitempty,max=16,dive,keys,max=64,endkeys,max=512"`
+	MetaData        *map[string]string `json:"meta_data" binding:"omitempty,max=16,dive,keys,max=64,endkeys,max=512"`
 }
 
-func CreateChat(c *gin.Context) {
-	userID, err := GetUserId(c)
-	if err != nil {
-		return
-	}
-	userIdStr := fmt.Sprintf("%d", userID)
-	var req createChatRequest
+// UpdateConversation PATCH /coze/conversation/:id, rename or (un)archive
+func UpdateConversation(c *gin.Context) {
+	var req updateConversationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.Report{
 			Code:   40000,
-			Result: "Invalid request parameters" + err.Error(),
+			Result: "Invalid request parameters",
 		})
 		return
 	}
 
-	type cozeMessage struct {
-		Role        string `json:"role"`
-		Type        string `json:"type"`
-		ContentType string `json:"content_type"`
-		Content     string `json:"content"`
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	conversation, err := GetUserConversation(c, userID, c.Param("id"))
+	if err != nil {
+		return
 	}
 
-	type cozeChatPayload struct {
-		BotID              string        `json:"bot_id"`
-		UserID             string        `json:"user_id"`
-		Stream             bool          `json:"stream"`
-		AdditionalMessages []cozeMessage `json:"additional_messages"`
+	var columns []string
+	if req.Name != nil {
+		conversation.Name = *req.Name
+		columns = append(columns, "name")
+	}
+	if req.Archived != nil {
+		conversation.Archived = *req.Archived
+		columns = append(columns, "archived")
+	}
+	if req.CustomVariables != nil {
+		conversation.CustomVariables = *req.CustomVariables
+		columns = append(columns, "custom_variables")
+	}
+	if req.MetaData != nil {
+		conversation.MetaData = *req.MetaData
+		columns = append(columns, "meta_data")
+	}
+	if len(columns) > 0 {
+		result := db.DB.Table(consts.ConversationTable).Select(columns).Updates(conversation)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50004,
+				Result: "Failed to update conversation",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, conversation)
+}
+
+// DeleteConversation DELETE /coze/conversation/:id, ?clear=true also clears the context on Coze
+func DeleteConversation(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	conversation, err := GetUserConversation(c, userID, c.Param("id"))
+	if err != nil {
+		return
 	}
 
-	cozeReq := cozeChatPayload{
-		BotID:  consts.BotID,
-		UserID: userIdStr,
-		Stream: false,
-		AdditionalMessages: []cozeMessage{
-			{
-				Role:        "user",
-				Type:        "question",
-				ContentType: "text",
-				Content:     req.Message,
-			},
-		},
+	if c.Query("clear") == "true" {
+		backend, err := GetConversationProvider(c, conversation)
+		if err != nil {
+			return
+		}
+		if _, err := provider.ClearConversation(c.Request.Context(), backend, conversation.ConversationID); err != nil {
+			reportUpstreamError(c, err)
+			return
+		}
 	}
 
-	cozeReqBody, err := json.Marshal(cozeReq)
+	// usage rows are kept for accounting
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.MessageTable).Where("conversation_id = ?", conversation.ConversationID).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(consts.ChatTable).Where("conversation_id = ?", conversation.ConversationID).Delete(&models.Chat{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.ConversationTable).Delete(conversation).Error
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50001,
-			Result: "Failed to create request body",
+			Code:   50005,
+			Result: "Failed to delete conversation",
 		})
 		return
 	}
 
-	var prettyJSON bytes.Buffer
-	if err := json.Indent(&prettyJSON, cozeReqBody, "", "  "); err == nil {
-		fmt.Printf("Coze API Request:\n%s\n", prettyJSON.String())
-	} else {
-		fmt.Printf("Coze API Request: %s\n", string(cozeReqBody))
-	}
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Conversation deleted",
+	})
+}
+
+type clearConversationResponse struct {
+	ConversationID string `json:"conversation_id"`
+	SectionID      string `json:"section_id"`
+}
 
-	client := &http.Client{}
-	apiURL := consts.CreateChatURL
-	if req.ConversationID != "" {
-		apiURL += "?conversation_id=" + req.ConversationID
+// ClearConversation POST /coze/conversation/:id/clear, start fresh in the same conversation
+func ClearConversation(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
 	}
-	proxyReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(cozeReqBody))
+	conversation, err := GetUserConversation(c, userID, c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50002,
-			Result: "Failed to create request",
-		})
 		return
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+models.CozeToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(proxyReq)
+	backend, err := GetConversationProvider(c, conversation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50003,
-			Result: "Failed to call external API",
-		})
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	section, err := provider.ClearConversation(c.Request.Context(), backend, conversation.ConversationID)
 	if err != nil {
+		reportUpstreamError(c, err)
+		return
+	}
+
+	result := db.DB.Table(consts.ConversationTable).Where("id = ?", conversation.ID).Update("section_id", section.ID)
+	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, models.Report{
 			Code:   50004,
-			Result: "Failed to read response",
+			Result: "Failed to update conversation",
 		})
 		return
 	}
+	saveSectionBoundary(conversation.ConversationID, section.ID)
 
-	type cozeAPIResponse struct {
-		Code int `json:"code"`
-		Data struct {
-			ID             string `json:"id"`
-			ConversationID string `json:"conversation_id"`
-			Status         string `json:"status"`
-		} `json:"data"`
-		Msg string `json:"msg"`
+	c.JSON(http.StatusOK, clearConversationResponse{
+		ConversationID: conversation.ConversationID,
+		SectionID:      section.ID,
+	})
+}
+
+type createChatRequest struct {
+	ConversationID string           `json:"conversation_id" binding:"required"`
+	Message        string           `json:"message" binding:"required_without=Attachments"`
+	Attachments    []chatAttachment `json:"attachments" binding:"omitempty,max=10,dive"`
+}
+
+type createChatResponse struct {
+	ConversationID string `json:"conversation_id"`
+	ChatID         string `json:"chat_id"`
+	Status         string `json:"status"`
+}
+
+// prepareChat runs the checks shared by every endpoint that sends a message,
+// picks the provider of the bot and builds the question
+func prepareChat(c *gin.Context, userID uint, req *createChatRequest) (*models.Conversation, provider.Provider, *coze.EnterMessage, error) {
+	// required_without is satisfied by an empty attachments array
+	if req.Message == "" && len(req.Attachments) == 0 {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters: message or attachments are required",
+		})
+		c.Abort()
+		return nil, nil, nil, errors.New("empty question")
 	}
-	var cozeResp cozeAPIResponse
-	if err := json.Unmarshal(body, &cozeResp); err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50005,
-			Result: "Failed to parse external response",
+	conversation, err := GetUserConversation(c, userID, req.ConversationID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bot, err := GetUsableBot(c, conversation.BotID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backend, err := GetBotProvider(c, bot)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(req.Attachments) > 0 && !provider.SupportsUpload(backend) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40021,
+			Result: "This bot does not accept attachments",
 		})
+		c.Abort()
+		return nil, nil, nil, errors.New("bot does not accept attachments")
+	}
+	if err := CheckUserQuota(c, userID); err != nil {
+		return nil, nil, nil, err
+	}
+	question, err := buildQuestion(c, userID, bot, req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return conversation, backend, question, nil
+}
+
+// newChatRequest builds the Coze chat request for a user question
+func newChatRequest(userID uint, conversation *models.Conversation, question *coze.EnterMessage) *coze.ChatRequest {
+	return &coze.ChatRequest{
+		BotID:              conversation.BotID,
+		UserID:             fmt.Sprintf("%d", userID),
+		AdditionalMessages: []coze.EnterMessage{*question},
+		CustomVariables:    conversation.CustomVariables,
+		MetaData:           conversation.MetaData,
+	}
+}
+
+func CreateChat(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
 		return
 	}
-	if cozeResp.Code != 0 {
-		c.JSON(http.StatusBadGateway, models.Report{
-			Code:   cozeResp.Code,
-			Result: cozeResp.Msg,
+	var req createChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters" + err.Error(),
 		})
 		return
 	}
 
+	conversation, backend, question, err := prepareChat(c, userID, &req)
+	if err != nil {
+		return
+	}
+
+	chat, err := backend.Chat(c.Request.Context(), req.ConversationID, newChatRequest(userID, conversation, question))
+	if err != nil {
+		reportUpstreamError(c, err)
+		return
+	}
+	saveChatStatus(userID, chat)
+	saveQuestion(conversation, chat.ID, question)
+	go watchChat(backend, userID, chat.ConversationID, chat.ID)
+
 	c.JSON(http.StatusOK, createChatResponse{
-		ConversationID: cozeResp.Data.ConversationID,
-		ChatID:         cozeResp.Data.ID,
-		Status:         cozeResp.Data.Status,
+		ConversationID: chat.ConversationID,
+		ChatID:         chat.ID,
+		Status:         chat.Status,
 	})
 }
 
@@ -337,84 +550,75 @@ func RetrieveConversation(c *gin.Context) {
 		return
 	}
 
-	client := &http.Client{}
-	apiURL := consts.RetrieveConversationURL + "?conversation_id=" + req.ConversationID + "&chat_id=" + req.ChatID
-
-	proxyReq, err := http.NewRequest("GET", apiURL, nil)
+	userID, err := GetUserId(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50001,
-			Result: "Failed to create request",
-		})
 		return
 	}
-
-	proxyReq.Header.Set("Authorization", "Bearer "+models.CozeToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(proxyReq)
+	conversation, err := GetUserConversation(c, userID, req.ConversationID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50002,
-			Result: "Failed to call external API",
-		})
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	backend, err := GetConversationProvider(c, conversation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50003,
-			Result: "Failed to read response",
-		})
 		return
 	}
 
 	/*
 		{"code":0,"data":{"bot_id":"7563218003241058343","completed_at":1766909715,"conversation_id":"7588818179242721321","created_at":1766909711,"id":"7588819419779039272","status":"completed","usage":{"input_count":972,"input_tokens_details":{"cached_tokens":0},"output_count":180,"output_tokens_details":{"reasoning_tokens":0},"token_count":1152}},"detail":{"logid":"2025122816153901654CB1627CB59025E7"},"msg":""}
 	*/
-
-	type cozeAPIResponse struct {
-		Code int `json:"code"`
-		Data struct {
-			Status string `json:"status"`
-		} `json:"data"`
-		Msg string `json:"msg"`
-	}
-
-	var cozeResp cozeAPIResponse
-	if err := json.Unmarshal(body, &cozeResp); err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50004,
-			Result: "Failed to parse external response",
-		})
+	chat, err := backend.RetrieveChat(c.Request.Context(), req.ConversationID, req.ChatID)
+	if err != nil {
+		reportUpstreamError(c, err)
 		return
 	}
-	if cozeResp.Code != 0 {
-		c.JSON(http.StatusBadGateway, models.Report{
-			Code:   cozeResp.Code,
-			Result: cozeResp.Msg,
-		})
-		return
+	saveChatStatus(userID, chat)
+	if chat.Status == coze.ChatStatusRequiresAction {
+		next, err := resolveRequiredAction(c.Request.Context(), backend, userID, chat)
+		if err != nil {
+			log.Println("Failed to resolve required action:", err)
+		} else {
+			chat = next
+		}
+	}
+	if chat.Status == coze.ChatStatusCompleted {
+		syncChatMessages(c.Request.Context(), backend, chat)
+		recordUsage(userID, chat)
 	}
 
 	c.JSON(http.StatusOK, retrieveConversationResponse{
-		Status: cozeResp.Data.Status,
+		Status: chat.Status,
 	})
 }
 
+type chatMessage struct {
+	ID        string `json:"id,omitempty"`
+	Content   string `json:"content"`
+	Role      string `json:"role"`
+	Type      string `json:"type"`
+	SectionID string `json:"section_id,omitempty"`
+}
+
+func toChatMessages(messages []coze.Message) []chatMessage {
+	var result []chatMessage
+	for _, msg := range messages {
+		result = append(result, chatMessage{
+			ID:        msg.ID,
+			Content:   msg.Content,
+			Role:      msg.Role,
+			Type:      msg.Type,
+			SectionID: msg.SectionID,
+		})
+	}
+	return result
+}
+
 type ChatMessageListRequest struct {
 	ConversationID string `form:"conversation_id" binding:"required"`
 	ChatID         string `form:"chat_id" binding:"required"`
 }
 
 type ChatMessageListResponse struct {
-	Messages []struct {
-		Content string `json:"content"`
-		Role    string `json:"role"`
-		Type    string `json:"type"`
-	} `json:"messages"`
+	Messages []chatMessage `json:"messages"`
 }
 
 func ChatMessageList(c *gin.Context) {
@@ -427,92 +631,100 @@ func ChatMessageList(c *gin.Context) {
 		return
 	}
 
-	client := &http.Client{}
-	apiURL := consts.ChatMessageListURL + "?conversation_id=" + req.ConversationID + "&chat_id=" + req.ChatID
-
-	proxyReq, err := http.NewRequest("GET", apiURL, nil)
+	userID, err := GetUserId(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50001,
-			Result: "Failed to create request",
-		})
 		return
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+models.CozeToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(proxyReq)
+	conversation, err := GetUserConversation(c, userID, req.ConversationID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50002,
-			Result: "Failed to call external API",
-		})
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	backend, err := GetConversationProvider(c, conversation)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50003,
-			Result: "Failed to read response",
-		})
 		return
 	}
 
-	type cozeMessage struct {
-		Content string `json:"content"`
-		Role    string `json:"role"`
-		Type    string `json:"type"`
-	}
-
-	type cozeAPIResponse struct {
-		Code int           `json:"code"`
-		Data []cozeMessage `json:"data"`
-		Msg  string        `json:"msg"`
-	}
-
-	var cozeResp cozeAPIResponse
-	if err := json.Unmarshal(body, &cozeResp); err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50004,
-			Result: "Failed to parse external response",
-		})
-		return
-	}
-	if cozeResp.Code != 0 {
-		c.JSON(http.StatusBadGateway, models.Report{
-			Code:   cozeResp.Code,
-			Result: cozeResp.Msg,
-		})
+	messages, err := backend.ListChatMessages(c.Request.Context(), req.ConversationID, req.ChatID)
+	if err != nil {
+		reportUpstreamError(c, err)
 		return
 	}
-	response := &ChatMessageListResponse{}
 
-	for _, msg := range cozeResp.Data {
-		response.Messages = append(response.Messages, struct {
-			Content string `json:"content"`
-			Role    string `json:"role"`
-			Type    string `json:"type"`
-		}{
-			Content: msg.Content,
-			Role:    msg.Role,
-			Type:    msg.Type,
-		})
-	}
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, &ChatMessageListResponse{
+		Messages: toChatMessages(messages),
+	})
 }
 
 type conversationMessageListRequest struct {
 	ConversationID string `form:"conversation_id" binding:"required"`
+	SectionID      string `form:"section_id"`
+	Limit          int    `form:"limit" binding:"omitempty,min=1,max=50"`
+	Order          string `form:"order" binding:"omitempty,oneof=asc desc"`
+	BeforeID       string `form:"before_id"`
+	AfterID        string `form:"after_id"`
 }
 
 type conversationMessageListResponse struct {
-	Messages []struct {
-		Content string `json:"content"`
-		Role    string `json:"role"`
-		Type    string `json:"type"`
-	} `json:"messages"`
+	Messages []chatMessage `json:"messages"`
+	FirstID  string        `json:"first_id"`
+	LastID   string        `json:"last_id"`
+	HasMore  bool          `json:"has_more"`
+}
+
+// listSectionMessages pages through the conversation until opts.Limit messages
+// of the section are found, Coze cannot filter by section itself. FirstID and
+// LastID are the returned messages, so the usual cursors continue after them.
+func listSectionMessages(ctx context.Context, backend provider.Provider, conversationID string, sectionID string, opts *coze.ListMessagesRequest) (*coze.MessageList, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = consts.DefaultPageSize
+	}
+	page := *opts
+	asc := page.Order == coze.OrderAsc
+	// the cursor can only move on when it points the way the pages are ordered
+	canContinue := (asc && page.BeforeID == "") || (!asc && page.AfterID == "")
+
+	result := &coze.MessageList{}
+	filled := false
+	for i := 0; ; i++ {
+		list, err := backend.ListConversationMessages(ctx, conversationID, &page)
+		if err != nil {
+			return nil, err
+		}
+		for j, msg := range list.Messages {
+			if msg.SectionID != sectionID {
+				continue
+			}
+			result.Messages = append(result.Messages, msg)
+			if len(result.Messages) == limit {
+				filled = true
+				result.HasMore = j < len(list.Messages)-1 || list.HasMore
+				break
+			}
+		}
+		if filled {
+			break
+		}
+		// when we stop early the client continues from the last scanned message
+		result.HasMore = list.HasMore
+		result.LastID = list.LastID
+		if !list.HasMore || !canContinue || list.LastID == "" || i == consts.MaxSectionPages-1 {
+			break
+		}
+		if asc {
+			page.AfterID = list.LastID
+		} else {
+			page.BeforeID = list.LastID
+		}
+	}
+
+	if len(result.Messages) > 0 {
+		result.FirstID = result.Messages[0].ID
+		if filled || !result.HasMore {
+			result.LastID = result.Messages[len(result.Messages)-1].ID
+		}
+	}
+	return result, nil
 }
 
 func ConversationMessageList(c *gin.Context) {
@@ -524,78 +736,67 @@ func ConversationMessageList(c *gin.Context) {
 		})
 		return
 	}
-
-	client := &http.Client{}
-	apiURL := consts.ConversationMessageListURL + "?conversation_id=" + req.ConversationID
-
-	proxyReq, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50001,
-			Result: "Failed to create request",
+	if req.BeforeID != "" && req.AfterID != "" {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters: before_id and after_id are exclusive",
 		})
 		return
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+models.CozeToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(proxyReq)
+	userID, err := GetUserId(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50002,
-			Result: "Failed to call external API",
-		})
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	conversation, err := GetUserConversation(c, userID, req.ConversationID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50003,
-			Result: "Failed to read response",
-		})
-		return
-	}
-
-	type cozeMessage struct {
-		Content string `json:"content"`
-		Role    string `json:"role"`
-		Type    string `json:"type"`
-	}
-
-	type cozeAPIResponse struct {
-		Code int           `json:"code"`
-		Data []cozeMessage `json:"data"`
-		Msg  string        `json:"msg"`
-	}
-	var cozeResp cozeAPIResponse
-	if err := json.Unmarshal(body, &cozeResp); err != nil {
-		c.JSON(http.StatusInternalServerError, models.Report{
-			Code:   50004,
-			Result: "Failed to parse external response",
-		})
 		return
 	}
-	if cozeResp.Code != 0 {
-		c.JSON(http.StatusBadGateway, models.Report{
-			Code:   cozeResp.Code,
-			Result: cozeResp.Msg,
-		})
+	backend, err := GetConversationProvider(c, conversation)
+	if err != nil {
 		return
 	}
 
-	response := &conversationMessageListResponse{}
-	for _, msg := range cozeResp.Data {
-		response.Messages = append(response.Messages, struct {
-			Content string `json:"content"`
-			Role    string `json:"role"`
-			Type    string `json:"type"`
-		}{
-			Content: msg.Content,
-			Role:    msg.Role,
-			Type:    msg.Type,
-		})
+	opts := &coze.ListMessagesRequest{
+		Order:    req.Order,
+		BeforeID: req.BeforeID,
+		AfterID:  req.AfterID,
+		Limit:    req.Limit,
 	}
-	c.JSON(http.StatusOK, response)
+	var list *coze.MessageList
+	if req.SectionID != "" {
+		list, err = listSectionMessages(c.Request.Context(), backend, req.ConversationID, req.SectionID, opts)
+	} else {
+		list, err = backend.ListConversationMessages(c.Request.Context(), req.ConversationID, opts)
+	}
+	if err != nil {
+		// 上游不可用时退回本地保存的历史, 不分页
+		var cozeErr *coze.Error
+		if !errors.As(err, &cozeErr) {
+			log.Println("Provider unreachable, serving local history:", err)
+			if local, dbErr := loadMessages(req.ConversationID, "", req.SectionID); dbErr == nil {
+				response := &conversationMessageListResponse{}
+				for _, msg := range local {
+					response.Messages = append(response.Messages, chatMessage{
+						ID:        msg.MessageID,
+						Content:   msg.Content,
+						Role:      msg.Role,
+						Type:      msg.Type,
+						SectionID: msg.SectionID,
+					})
+				}
+				c.JSON(http.StatusOK, response)
+				return
+			}
+		}
+		reportUpstreamError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &conversationMessageListResponse{
+		Messages: toChatMessages(list.Messages),
+		FirstID:  list.FirstID,
+		LastID:   list.LastID,
+		HasMore:  list.HasMore,
+	})
 }
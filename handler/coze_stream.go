@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"io"
+	"log"
+	"net/http"
+)
+
+type streamChatSummary struct {
+	ConversationID string      `json:"conversation_id"`
+	ChatID         string      `json:"chat_id"`
+	Status         string      `json:"status"`
+	Usage          *coze.Usage `json:"usage,omitempty"`
+}
+
+// StreamChat POST /coze/chat/stream, relay the chat of the bot provider as SSE
+func StreamChat(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	var req createChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters" + err.Error(),
+		})
+		return
+	}
+
+	conversation, backend, question, err := prepareChat(c, userID, &req)
+	if err != nil {
+		return
+	}
+
+	// 客户端断开时 request context 会被取消, 上游连接也随之关闭
+	stream, err := backend.StreamChat(c.Request.Context(), req.ConversationID, newChatRequest(userID, conversation, question))
+	if err != nil {
+		reportUpstreamError(c, err)
+		return
+	}
+	defer func() {
+		stream.Close()
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	summary := streamChatSummary{
+		ConversationID: req.ConversationID,
+	}
+	var completed []coze.Message
+	toolRounds := 0
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				log.Println("StreamChat: client disconnected, chat_id:", summary.ChatID)
+				if summary.ChatID != "" && !isChatFinished(summary.Status) {
+					cancelAbandonedChat(backend, userID, summary.ConversationID, summary.ChatID)
+				}
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			var cozeErr *coze.Error
+			if errors.As(err, &cozeErr) {
+				c.SSEvent(consts.StreamEventError, models.Report{
+					Code:   cozeErr.Code,
+					Result: cozeErr.Msg,
+				})
+			} else {
+				log.Println("StreamChat: read upstream stream error:", err)
+				c.SSEvent(consts.StreamEventError, models.Report{
+					Code:   50006,
+					Result: "Failed to read upstream stream",
+				})
+			}
+			c.Writer.Flush()
+			break
+		}
+
+		switch event.Event {
+		case consts.StreamEventChatCreated:
+			saveQuestion(conversation, event.Chat.ID, question)
+		case consts.StreamEventChatCompleted:
+			saveChatMessages(event.Chat, completed)
+			recordUsage(userID, event.Chat)
+		case consts.StreamEventMessageCompleted:
+			completed = append(completed, *event.Message)
+		}
+
+		if event.Chat != nil {
+			saveChatStatus(userID, event.Chat)
+			summary.ChatID = event.Chat.ID
+			summary.ConversationID = event.Chat.ConversationID
+			summary.Status = event.Chat.Status
+			if event.Chat.Usage != nil {
+				summary.Usage = event.Chat.Usage
+			}
+			c.SSEvent(event.Event, event.Chat)
+		} else {
+			c.SSEvent(event.Event, event.Message)
+		}
+		c.Writer.Flush()
+
+		// run the tools the bot asked for and continue with the stream of the answer
+		if event.Event == consts.StreamEventChatRequiresAction && toolRounds < consts.MaxToolRounds {
+			toolRounds++
+			outputs, _ := runRequiredTools(c.Request.Context(), userID, event.Chat)
+			if len(outputs) == 0 {
+				continue
+			}
+			next, err := provider.StreamSubmitToolOutputs(c.Request.Context(), backend, event.Chat.ConversationID, event.Chat.ID, outputs)
+			if err != nil {
+				log.Println("StreamChat: submit tool outputs error:", err)
+				c.SSEvent(consts.StreamEventError, models.Report{
+					Code:   50007,
+					Result: "Failed to submit tool outputs",
+				})
+				c.Writer.Flush()
+				break
+			}
+			stream.Close()
+			stream = next
+		}
+	}
+
+	c.SSEvent(consts.StreamEventSummary, summary)
+	c.Writer.Flush()
+}
@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ids of the recordings in testdata/cassette, the contents were redacted
+// when they were recorded
+const (
+	testConversationID = "7600000000000000101"
+	testSectionID      = "7600000000000000201"
+	testRedacted       = "[redacted]"
+)
+
+// replayCoze sends the default Coze client to the recorded scenario
+func replayCoze(t *testing.T, scenario string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cassette")
+	cfg, _ := json.Marshal(coze.CassetteConfig{Mode: coze.CassetteModeReplay, Dir: filepath.Join("testdata", "cassette", scenario)})
+	if err := os.WriteFile(path, cfg, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	coze.InitCassette(path)
+	old := coze.DefaultClient
+	coze.InitClient("test-token")
+	t.Cleanup(func() { coze.DefaultClient = old })
+}
+
+// setupChatTest creates a user with a conversation on the default bot and
+// returns a router that authenticates every request as that user
+func setupChatTest(t *testing.T, scenario string) *gin.Engine {
+	t.Helper()
+	setupTestDB(t)
+	replayCoze(t, scenario)
+
+	user := models.User{Username: "alice", Email: "alice@example.com", Password: "x", Role: consts.RoleStudent, EmailVerified: true}
+	if err := db.DB.Table(consts.UserTable).Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	bot := models.Bot{BotID: consts.BotID, Name: "Default", Enabled: true, Provider: consts.ProviderCoze}
+	if err := db.DB.Table(consts.BotTable).Create(&bot).Error; err != nil {
+		t.Fatal(err)
+	}
+	conversation := models.Conversation{UserID: user.ID, ConversationID: testConversationID, Name: "Go", BotID: consts.BotID, SectionID: testSectionID}
+	if err := db.DB.Table(consts.ConversationTable).Create(&conversation).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("id", "1")
+		c.Set("role", consts.RoleStudent)
+	})
+	r.POST("/coze/chat", CreateChat)
+	r.POST("/coze/chat/stream", StreamChat)
+	r.POST("/coze/chat/wait", WaitChat)
+	r.GET("/coze/conversation/message/list", ConversationMessageList)
+	return r
+}
+
+func doJSON(r *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func storedAnswers(t *testing.T, chatID string) []models.Message {
+	t.Helper()
+	var messages []models.Message
+	if err := db.DB.Table(consts.MessageTable).Where("chat_id = ? AND role = ?", chatID, coze.RoleAssistant).Order("id").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func storedUsage(t *testing.T, chatID string) *models.Usage {
+	t.Helper()
+	var usages []models.Usage
+	if err := db.DB.Table(consts.UsageTable).Where("chat_id = ?", chatID).Find(&usages).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 {
+		t.Fatalf("got %d usage rows for chat %s, want 1", len(usages), chatID)
+	}
+	return &usages[0]
+}
+
+const testQuestion = `{"conversation_id":"7600000000000000101","message":"What is a goroutine?"}`
+
+func TestCreateChatReplay(t *testing.T) {
+	r := setupChatTest(t, "create_chat")
+	chatID := "7600000000000000111"
+
+	w := doJSON(r, http.MethodPost, "/coze/chat", testQuestion)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var resp createChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ChatID != chatID || resp.ConversationID != testConversationID || resp.Status != coze.ChatStatusInProgress {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// the watcher retrieves the chat, stores the answer and records the usage
+	// last, without the client polling
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int64
+		db.DB.Table(consts.UsageTable).Where("chat_id = ?", chatID).Count(&count)
+		if count > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the watcher never finished the chat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	answers := storedAnswers(t, chatID)
+	if len(answers) != 2 || answers[0].Type != coze.MessageTypeAnswer || answers[0].Content != testRedacted || answers[1].Type != coze.MessageTypeFollowUp {
+		t.Fatalf("unexpected answers %+v", answers)
+	}
+	var question models.Message
+	db.DB.Table(consts.MessageTable).Where("chat_id = ? AND role = ?", chatID, coze.RoleUser).First(&question)
+	if question.Content != "What is a goroutine?" || question.SectionID != testSectionID {
+		t.Fatalf("unexpected question %+v", question)
+	}
+	if usage := storedUsage(t, chatID); usage.TokenCount != 30 || usage.InputCount != 12 || usage.OutputCount != 18 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	var chat models.Chat
+	db.DB.Table(consts.ChatTable).Where("chat_id = ?", chatID).First(&chat)
+	if chat.Status != coze.ChatStatusCompleted || chat.UserID != 1 {
+		t.Fatalf("unexpected chat %+v", chat)
+	}
+}
+
+func TestWaitChatReplay(t *testing.T) {
+	r := setupChatTest(t, "wait_chat")
+	chatID := "7600000000000000112"
+
+	w := doJSON(r, http.MethodPost, "/coze/chat/wait", testQuestion)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Code   int              `json:"code"`
+		Result waitChatResponse `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	result := resp.Result
+	if resp.Code != 20000 || result.ChatID != chatID || result.Status != coze.ChatStatusCompleted {
+		t.Fatalf("unexpected response %s", w.Body)
+	}
+	if len(result.Messages) != 2 || result.Messages[0].Type != coze.MessageTypeAnswer || result.Messages[1].Type != coze.MessageTypeFollowUp {
+		t.Fatalf("unexpected messages %+v", result.Messages)
+	}
+	if result.Usage == nil || result.Usage.TokenCount != 30 {
+		t.Fatalf("unexpected usage %+v", result.Usage)
+	}
+
+	if answers := storedAnswers(t, chatID); len(answers) != 2 || answers[0].InputCount != 12 {
+		t.Fatalf("unexpected stored answers %+v", answers)
+	}
+	if usage := storedUsage(t, chatID); usage.TokenCount != 30 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestWaitChatClientGone(t *testing.T) {
+	r := setupChatTest(t, "wait_chat")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/coze/chat/wait", strings.NewReader(testQuestion)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.Len() != 0 {
+		t.Fatalf("response written to a closed connection: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStreamChatReplay(t *testing.T) {
+	r := setupChatTest(t, "stream_chat")
+	chatID := "7600000000000000113"
+
+	w := doJSON(r, http.MethodPost, "/coze/chat/stream", testQuestion)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	var events []string
+	var summary streamChatSummary
+	for _, block := range strings.Split(w.Body.String(), "\n\n") {
+		var event, data string
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event:"); ok {
+				event = name
+			}
+			if value, ok := strings.CutPrefix(line, "data:"); ok {
+				data = value
+			}
+		}
+		if event == "" {
+			continue
+		}
+		events = append(events, event)
+		if event == consts.StreamEventSummary {
+			if err := json.Unmarshal([]byte(data), &summary); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := []string{
+		consts.StreamEventChatCreated,
+		consts.StreamEventChatInProgress,
+		consts.StreamEventMessageDelta,
+		consts.StreamEventMessageDelta,
+		consts.StreamEventMessageCompleted,
+		consts.StreamEventChatCompleted,
+		consts.StreamEventSummary,
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+	if summary.ChatID != chatID || summary.Status != coze.ChatStatusCompleted || summary.Usage == nil || summary.Usage.TokenCount != 30 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	if answers := storedAnswers(t, chatID); len(answers) != 1 || answers[0].Content != testRedacted {
+		t.Fatalf("unexpected stored answers %+v", answers)
+	}
+	if usage := storedUsage(t, chatID); usage.TokenCount != 30 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestConversationMessageListReplay(t *testing.T) {
+	r := setupChatTest(t, "message_list")
+
+	w := doJSON(r, http.MethodGet, "/coze/conversation/message/list?conversation_id="+testConversationID+"&section_id="+testSectionID+"&limit=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var resp conversationMessageListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != 2 || resp.Messages[0].ID != "7600000000000000304" || resp.Messages[1].Role != coze.RoleUser {
+		t.Fatalf("unexpected messages %+v", resp.Messages)
+	}
+	if resp.FirstID != "7600000000000000304" || resp.LastID != "7600000000000000303" || !resp.HasMore {
+		t.Fatalf("unexpected cursors %+v", resp)
+	}
+}
+
+func TestChatReplayRejectsOtherUsers(t *testing.T) {
+	r := setupChatTest(t, "create_chat")
+	other := models.Conversation{UserID: 2, ConversationID: "7600000000000000999", Name: "x", BotID: consts.BotID}
+	if err := db.DB.Table(consts.ConversationTable).Create(&other).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	w := doJSON(r, http.MethodPost, "/coze/chat", `{"conversation_id":"7600000000000000999","message":"Hi"}`)
+	if w.Code != http.StatusForbidden || !bytes.Contains(w.Body.Bytes(), []byte("40300")) {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestChatRejectsEmptyQuestion(t *testing.T) {
+	r := setupChatTest(t, "create_chat")
+
+	for _, path := range []string{"/coze/chat", "/coze/chat/stream", "/coze/chat/wait"} {
+		w := doJSON(r, http.MethodPost, path, `{"conversation_id":"7600000000000000101","attachments":[]}`)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	var count int64
+	db.DB.Table(consts.MessageTable).Count(&count)
+	if count != 0 {
+		t.Fatalf("got %d stored messages, want none", count)
+	}
+	var chats int64
+	db.DB.Table(consts.ChatTable).Count(&chats)
+	if chats != 0 {
+		t.Fatalf("got %d chats, want none", chats)
+	}
+}
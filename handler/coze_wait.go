@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"net/http"
+	"time"
+)
+
+type waitChatRequest struct {
+	createChatRequest
+	Timeout int `json:"timeout" binding:"omitempty,min=1"` // seconds
+}
+
+type waitChatResponse struct {
+	ConversationID string          `json:"conversation_id"`
+	ChatID         string          `json:"chat_id"`
+	Status         string          `json:"status"`
+	Messages       []chatMessage   `json:"messages,omitempty"`
+	Usage          *coze.Usage     `json:"usage,omitempty"`
+	LastError      *coze.LastError `json:"last_error,omitempty"`
+}
+
+// pollChat retrieves the chat with backoff until it leaves the in progress states,
+// tool calls the bot asks for are answered on the way
+func pollChat(ctx context.Context, backend provider.Provider, userID uint, conversationID string, chatID string) (*coze.Chat, error) {
+	interval := consts.ChatPollInterval
+	toolRounds := 0
+	for {
+		chat, err := backend.RetrieveChat(ctx, conversationID, chatID)
+		if err != nil {
+			return nil, err
+		}
+		switch chat.Status {
+		case coze.ChatStatusCreated, coze.ChatStatusInProgress:
+		case coze.ChatStatusRequiresAction:
+			if toolRounds >= consts.MaxToolRounds {
+				return chat, nil
+			}
+			toolRounds++
+			if _, err := resolveRequiredAction(ctx, backend, userID, chat); err != nil {
+				return nil, err
+			}
+			interval = consts.ChatPollInterval
+		default:
+			return chat, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return chat, ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > consts.MaxChatPollInterval {
+			interval = consts.MaxChatPollInterval
+		}
+	}
+}
+
+// clientGone reports whether the client closed the connection, there is
+// nobody left to read a response then
+func clientGone(c *gin.Context) bool {
+	return errors.Is(c.Request.Context().Err(), context.Canceled)
+}
+
+// WaitChat POST /coze/chat/wait, send a message and wait for the answer
+func WaitChat(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	var req waitChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters" + err.Error(),
+		})
+		return
+	}
+
+	conversation, backend, question, err := prepareChat(c, userID, &req.createChatRequest)
+	if err != nil {
+		return
+	}
+
+	timeout := consts.ChatWaitTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+	if timeout > consts.MaxChatWaitTimeout {
+		timeout = consts.MaxChatWaitTimeout
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	chat, err := backend.Chat(ctx, req.ConversationID, newChatRequest(userID, conversation, question))
+	if err != nil {
+		if clientGone(c) {
+			return
+		}
+		reportUpstreamError(c, err)
+		return
+	}
+	saveChatStatus(userID, chat)
+	saveQuestion(conversation, chat.ID, question)
+
+	response := waitChatResponse{
+		ConversationID: chat.ConversationID,
+		ChatID:         chat.ID,
+		Status:         chat.Status,
+	}
+
+	chat, err = pollChat(ctx, backend, userID, req.ConversationID, chat.ID)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the chat keeps running upstream without us
+			go watchChat(backend, userID, response.ConversationID, response.ChatID)
+		}
+		if clientGone(c) {
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the client can still poll GET /coze/chat
+			c.JSON(http.StatusGatewayTimeout, models.Report{
+				Code:   50400,
+				Result: response,
+			})
+			return
+		}
+		reportUpstreamError(c, err)
+		return
+	}
+
+	saveChatStatus(userID, chat)
+	response.Status = chat.Status
+	response.Usage = chat.Usage
+	response.LastError = chat.LastError
+
+	switch chat.Status {
+	case coze.ChatStatusCompleted:
+	case coze.ChatStatusFailed:
+		c.JSON(http.StatusBadGateway, models.Report{
+			Code:   50020,
+			Result: response,
+		})
+		return
+	case coze.ChatStatusRequiresAction:
+		c.JSON(http.StatusConflict, models.Report{
+			Code:   40900,
+			Result: response,
+		})
+		return
+	case coze.ChatStatusCanceled:
+		c.JSON(http.StatusConflict, models.Report{
+			Code:   40901,
+			Result: response,
+		})
+		return
+	default:
+		c.JSON(http.StatusBadGateway, models.Report{
+			Code:   50021,
+			Result: response,
+		})
+		return
+	}
+
+	messages, err := backend.ListChatMessages(ctx, chat.ConversationID, chat.ID)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the answer is still stored for the history
+			go watchChat(backend, userID, chat.ConversationID, chat.ID)
+		}
+		if clientGone(c) {
+			return
+		}
+		reportUpstreamError(c, err)
+		return
+	}
+	saveChatMessages(chat, messages)
+	recordUsage(userID, chat)
+
+	for _, msg := range messages {
+		if msg.Type == coze.MessageTypeAnswer || msg.Type == coze.MessageTypeFollowUp {
+			response.Messages = append(response.Messages, chatMessage{
+				Content: msg.Content,
+				Role:    msg.Role,
+				Type:    msg.Type,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: response,
+	})
+}
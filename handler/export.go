@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/export"
+	"log"
+	"net/http"
+	"time"
+)
+
+// exportedTypes are the message types worth keeping in an export, tool
+// calls and verbose messages are left out
+var exportedTypes = map[string]bool{
+	coze.MessageTypeQuestion:  true,
+	coze.MessageTypeAnswer:    true,
+	coze.MessageTypeFollowUp:  true,
+	consts.MessageTypeSection: true,
+}
+
+// botNames maps bot ids to their display names
+func botNames() map[string]string {
+	bots := []models.Bot{}
+	if err := db.DB.Table(consts.BotTable).Find(&bots).Error; err != nil {
+		log.Println("Failed to query bots:", err)
+	}
+	names := make(map[string]string, len(bots))
+	for _, bot := range bots {
+		names[bot.BotID] = bot.Name
+	}
+	return names
+}
+
+// buildTranscript collects the local history of the conversation for export
+func buildTranscript(conversation *models.Conversation, names map[string]string, exportedAt time.Time) (*export.Transcript, error) {
+	messages, err := loadMessages(conversation.ConversationID, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := &export.Transcript{
+		ConversationID: conversation.ConversationID,
+		Title:          conversation.Name,
+		BotName:        names[conversation.BotID],
+		CreatedAt:      conversation.CreatedAt,
+		ExportedAt:     exportedAt,
+		Entries:        []export.Entry{},
+	}
+	for _, msg := range messages {
+		if !exportedTypes[msg.Type] {
+			continue
+		}
+		transcript.Entries = append(transcript.Entries, export.Entry{
+			Role:      msg.Role,
+			Type:      msg.Type,
+			Content:   export.DisplayContent(msg.ContentType, msg.Content),
+			CreatedAt: msg.CreatedAt,
+			Section:   msg.Type == consts.MessageTypeSection,
+		})
+	}
+	return transcript, nil
+}
+
+func exportFileName(conversationID string, format string) string {
+	return fmt.Sprintf("conversation-%s.%s", conversationID, format)
+}
+
+type exportRequest struct {
+	Format string `form:"format" binding:"omitempty,oneof=md json html"`
+}
+
+// bindExportFormat reads the format from the query, markdown by default
+func bindExportFormat(c *gin.Context) (string, error) {
+	var req exportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters, format must be md, json or html",
+		})
+		c.Abort()
+		return "", err
+	}
+	if req.Format == "" {
+		return export.FormatMarkdown, nil
+	}
+	return req.Format, nil
+}
+
+// ExportConversation GET /coze/conversation/:id/export?format=md|json|html
+func ExportConversation(c *gin.Context) {
+	format, err := bindExportFormat(c)
+	if err != nil {
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	conversation, err := GetUserConversation(c, userID, c.Param("id"))
+	if err != nil {
+		return
+	}
+
+	transcript, err := buildTranscript(conversation, botNames(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50011,
+			Result: "Failed to retrieve messages from database",
+		})
+		return
+	}
+
+	c.Header("Content-Type", export.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(conversation.ConversationID, format)))
+	c.Status(http.StatusOK)
+	if err := export.Render(c.Writer, format, transcript); err != nil {
+		log.Println("Failed to render conversation export:", err)
+	}
+}
+
+// ExportAllConversations GET /coze/conversation/export?format=md|json|html,
+// every conversation of the user in one zip archive
+func ExportAllConversations(c *gin.Context) {
+	format, err := bindExportFormat(c)
+	if err != nil {
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	conversations := []models.Conversation{}
+	result := db.DB.Table(consts.ConversationTable).
+		Where("user_id = ?", userID).
+		Order("created_at, id").
+		Find(&conversations)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50010,
+			Result: "Failed to query conversation",
+		})
+		return
+	}
+
+	// load everything before writing so a database error can still be reported
+	names := botNames()
+	now := time.Now()
+	transcripts := make([]*export.Transcript, 0, len(conversations))
+	for i := range conversations {
+		transcript, err := buildTranscript(&conversations[i], names, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50011,
+				Result: "Failed to retrieve messages from database",
+			})
+			return
+		}
+		transcripts = append(transcripts, transcript)
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "conversations-"+now.Format("20060102-150405")+".zip"))
+	c.Status(http.StatusOK)
+
+	archive := zip.NewWriter(c.Writer)
+	for _, transcript := range transcripts {
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     exportFileName(transcript.ConversationID, format),
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			log.Println("Failed to write export archive:", err)
+			return
+		}
+		if err := export.Render(entry, format, transcript); err != nil {
+			log.Println("Failed to render conversation export:", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Println("Failed to write export archive:", err)
+	}
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// uploadTarget picks the bot the file is uploaded for from the optional form
+// fields bot_id or conversation_id, a bot with its own API key keeps its files
+// in its own account. Without either the default account is used.
+func uploadTarget(c *gin.Context, userID uint) (string, provider.Provider, error) {
+	botID := c.PostForm("bot_id")
+	if conversationID := c.PostForm("conversation_id"); conversationID != "" {
+		conversation, err := GetUserConversation(c, userID, conversationID)
+		if err != nil {
+			return "", nil, err
+		}
+		botID = conversation.BotID
+	}
+	if botID == "" {
+		return "", provider.Default(), nil
+	}
+
+	bot, err := GetUsableBot(c, botID)
+	if err != nil {
+		return "", nil, err
+	}
+	backend, err := GetBotProvider(c, bot)
+	if err != nil {
+		return "", nil, err
+	}
+	if !provider.SupportsUpload(backend) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40021,
+			Result: "This bot does not accept attachments",
+		})
+		c.Abort()
+		return "", nil, errors.New("bot does not accept attachments")
+	}
+	return fileAccount(bot), backend, nil
+}
+
+// fileAccount is the File.BotID of files usable with the bot
+func fileAccount(bot *models.Bot) string {
+	if bot.APIKey == "" {
+		return ""
+	}
+	return bot.BotID
+}
+
+// UploadFile POST /coze/file, multipart field "file" and optionally bot_id or conversation_id
+func UploadFile(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, consts.MaxUploadSize+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40020,
+			Result: "Missing file or file too large",
+		})
+		return
+	}
+	if header.Size > consts.MaxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, models.Report{
+			Code:   41300,
+			Result: "File too large",
+		})
+		return
+	}
+
+	botID, backend, err := uploadTarget(c, userID)
+	if err != nil {
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50060,
+			Result: "Failed to read uploaded file",
+		})
+		return
+	}
+	defer file.Close()
+
+	// trust the content, not the type the client claims
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50060,
+			Result: "Failed to read uploaded file",
+		})
+		return
+	}
+	sniff = sniff[:n]
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(sniff))
+	if !consts.AllowedUploadTypes[mimeType] {
+		c.JSON(http.StatusUnsupportedMediaType, models.Report{
+			Code:   41500,
+			Result: "Unsupported file type: " + mimeType,
+		})
+		return
+	}
+
+	fileName := filepath.Base(header.Filename)
+	uploaded, err := provider.UploadFile(c.Request.Context(), backend, fileName, io.MultiReader(bytes.NewReader(sniff), file))
+	if err != nil {
+		reportUpstreamError(c, err)
+		return
+	}
+
+	row := models.File{
+		FileID:   uploaded.ID,
+		UserID:   userID,
+		BotID:    botID,
+		FileName: fileName,
+		MimeType: mimeType,
+		Bytes:    uploaded.Bytes,
+	}
+	if err := db.DB.Table(consts.FileTable).Create(&row).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50061,
+			Result: "Failed to save file to database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: row,
+	})
+}
+
+type chatAttachment struct {
+	Type   string `json:"type" binding:"required,oneof=image file"`
+	FileID string `json:"file_id" binding:"required"`
+}
+
+// buildQuestion turns the request into the message sent to Coze, attachments
+// must be files the user uploaded for the account of the bot and make it an
+// object_string message
+func buildQuestion(c *gin.Context, userID uint, bot *models.Bot, req *createChatRequest) (*coze.EnterMessage, error) {
+	question := &coze.EnterMessage{
+		Role:        coze.RoleUser,
+		Type:        coze.MessageTypeQuestion,
+		ContentType: coze.ContentTypeText,
+		Content:     req.Message,
+	}
+	if len(req.Attachments) == 0 {
+		return question, nil
+	}
+
+	seen := map[string]bool{}
+	var fileIDs []string
+	for _, attachment := range req.Attachments {
+		if !seen[attachment.FileID] {
+			seen[attachment.FileID] = true
+			fileIDs = append(fileIDs, attachment.FileID)
+		}
+	}
+	var count int64
+	result := db.DB.Table(consts.FileTable).
+		Where("user_id = ? AND file_id IN ? AND bot_id = ?", userID, fileIDs, fileAccount(bot)).
+		Distinct("file_id").
+		Count(&count)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50062,
+			Result: "Failed to query files",
+		})
+		c.Abort()
+		return nil, result.Error
+	}
+	if int(count) != len(fileIDs) {
+		c.JSON(http.StatusNotFound, models.Report{
+			Code:   40403,
+			Result: "Attachment file not found",
+		})
+		c.Abort()
+		return nil, errors.New("attachment file not found")
+	}
+
+	var items []coze.ObjectItem
+	if req.Message != "" {
+		items = append(items, coze.ObjectItem{Type: coze.ObjectTypeText, Text: req.Message})
+	}
+	for _, attachment := range req.Attachments {
+		items = append(items, coze.ObjectItem{Type: attachment.Type, FileID: attachment.FileID})
+	}
+	content, err := json.Marshal(items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50001,
+			Result: "Failed to create request body",
+		})
+		c.Abort()
+		return nil, err
+	}
+
+	question.ContentType = coze.ContentTypeObjectString
+	question.Content = string(content)
+	return question, nil
+}
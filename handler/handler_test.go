@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net/url"
+	"testing"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// setupTestDB points db.DB at an empty in-memory database for the test
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open("file:"+url.PathEscape(t.Name())+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one connection, so background goroutines of the handlers queue up
+	// instead of failing on a locked table
+	if sqlDB, err := conn.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1)
+	}
+	tables := []struct {
+		name  string
+		model interface{}
+	}{
+		{consts.UserTable, &models.User{}},
+		{consts.ConversationTable, &models.Conversation{}},
+		{consts.MessageTable, &models.Message{}},
+		{consts.UsageTable, &models.Usage{}},
+		{consts.QuotaTable, &models.Quota{}},
+		{consts.BotTable, &models.Bot{}},
+		{consts.ChatTable, &models.Chat{}},
+		{consts.FileTable, &models.File{}},
+		{consts.ToolCallTable, &models.ToolCall{}},
+		{consts.WebhookTable, &models.Webhook{}},
+		{consts.DeliveryTable, &models.WebhookDelivery{}},
+		{consts.AccessTokenTable, &models.AccessToken{}},
+		{consts.RefreshTokenTable, &models.RefreshToken{}},
+		{consts.PasswordResetTable, &models.PasswordReset{}},
+	}
+	for _, table := range tables {
+		if err := conn.Table(table.name).AutoMigrate(table.model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := db.DB
+	db.DB = conn
+	t.Cleanup(func() {
+		db.DB = old
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
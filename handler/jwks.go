@@ -0,0 +1,13 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/utils/jwt"
+	"net/http"
+)
+
+// JWKS GET /.well-known/jwks.json, the public keys other services verify our tokens with
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwt.Keys.JWKS())
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// touchConversation moves the conversation to the top of the activity order
+func touchConversation(conversationID string) {
+	result := db.DB.Table(consts.ConversationTable).
+		Where("conversation_id = ?", conversationID).
+		Update("last_message_at", time.Now())
+	if result.Error != nil {
+		log.Println("Failed to update conversation activity:", result.Error)
+	}
+}
+
+// saveQuestion stores the message the user sent in a chat
+func saveQuestion(conversation *models.Conversation, chatID string, question *coze.EnterMessage) {
+	message := models.Message{
+		ConversationID: conversation.ConversationID,
+		ChatID:         chatID,
+		SectionID:      conversation.SectionID,
+		Role:           question.Role,
+		Type:           question.Type,
+		ContentType:    question.ContentType,
+		Content:        question.Content,
+	}
+	if err := db.DB.Table(consts.MessageTable).Create(&message).Error; err != nil {
+		log.Println("Failed to save question message:", err)
+	}
+	touchConversation(conversation.ConversationID)
+}
+
+// saveChatMessages stores the bot messages of a finished chat, messages
+// already stored are skipped. The chat usage is kept on the answer.
+func saveChatMessages(chat *coze.Chat, messages []coze.Message) {
+	var stored []string
+	result := db.DB.Table(consts.MessageTable).
+		Where("chat_id = ? AND message_id <> ''", chat.ID).
+		Pluck("message_id", &stored)
+	if result.Error != nil {
+		log.Println("Failed to query stored messages:", result.Error)
+		return
+	}
+	exists := make(map[string]bool, len(stored))
+	for _, id := range stored {
+		exists[id] = true
+	}
+
+	usageSaved := false
+	var rows []models.Message
+	for _, msg := range messages {
+		if msg.Role == coze.RoleUser || exists[msg.ID] {
+			continue
+		}
+		row := models.Message{
+			ConversationID: chat.ConversationID,
+			ChatID:         chat.ID,
+			MessageID:      msg.ID,
+			SectionID:      msg.SectionID,
+			Role:           msg.Role,
+			Type:           msg.Type,
+			ContentType:    msg.ContentType,
+			Content:        msg.Content,
+		}
+		if msg.CreatedAt > 0 {
+			upstream := time.Unix(msg.CreatedAt, 0)
+			row.UpstreamCreatedAt = &upstream
+		}
+		if !usageSaved && chat.Usage != nil && msg.Type == coze.MessageTypeAnswer {
+			row.InputCount = chat.Usage.InputCount
+			row.OutputCount = chat.Usage.OutputCount
+			row.TokenCount = chat.Usage.TokenCount
+			usageSaved = true
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	if err := db.DB.Table(consts.MessageTable).Create(&rows).Error; err != nil {
+		log.Println("Failed to save chat messages:", err)
+	}
+	touchConversation(chat.ConversationID)
+}
+
+// syncChatMessages fetches the messages of a completed chat from the provider once
+func syncChatMessages(ctx context.Context, backend provider.Provider, chat *coze.Chat) {
+	var count int64
+	result := db.DB.Table(consts.MessageTable).
+		Where("chat_id = ? AND role = ?", chat.ID, coze.RoleAssistant).
+		Count(&count)
+	if result.Error != nil {
+		log.Println("Failed to query stored messages:", result.Error)
+		return
+	}
+	if count > 0 {
+		return
+	}
+
+	messages, err := backend.ListChatMessages(ctx, chat.ConversationID, chat.ID)
+	if err != nil {
+		log.Println("Failed to fetch chat messages:", err)
+		return
+	}
+	saveChatMessages(chat, messages)
+}
+
+// saveSectionBoundary marks in the local history where the context was cleared
+func saveSectionBoundary(conversationID string, sectionID string) {
+	message := models.Message{
+		ConversationID: conversationID,
+		SectionID:      sectionID,
+		Role:           consts.MessageRoleSystem,
+		Type:           consts.MessageTypeSection,
+		ContentType:    coze.ContentTypeText,
+	}
+	if err := db.DB.Table(consts.MessageTable).Create(&message).Error; err != nil {
+		log.Println("Failed to save section boundary:", err)
+	}
+}
+
+// likeContains builds the pattern of a "contains" search for LIKE ... ESCAPE '\',
+// wildcards in the user input match only themselves
+func likeContains(query string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(query) + "%"
+}
+
+// loadMessages returns the locally stored history of a conversation,
+// query and sectionID are optional filters
+func loadMessages(conversationID string, query string, sectionID string) ([]models.Message, error) {
+	messages := []models.Message{}
+	tx := db.DB.Table(consts.MessageTable).Where("conversation_id = ?", conversationID)
+	if query != "" {
+		tx = tx.Where("content ILIKE ? ESCAPE '\\'", likeContains(query))
+	}
+	if sectionID != "" {
+		tx = tx.Where("section_id = ?", sectionID)
+	}
+	// insertion order, a question and its answer often share the same second
+	result := tx.Order("id").Find(&messages)
+	return messages, result.Error
+}
+
+type messageHistoryRequest struct {
+	ConversationID string `form:"conversation_id" binding:"required"`
+	Query          string `form:"q"`
+	SectionID      string `form:"section_id"`
+}
+
+type messageHistoryResponse struct {
+	Messages []models.Message `json:"messages"`
+}
+
+// MessageHistory GET /coze/conversation/history, serve history from the local store
+func MessageHistory(c *gin.Context) {
+	var req messageHistoryRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	if _, err := GetUserConversation(c, userID, req.ConversationID); err != nil {
+		return
+	}
+
+	messages, err := loadMessages(req.ConversationID, req.Query, req.SectionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50011,
+			Result: "Failed to retrieve messages from database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, messageHistoryResponse{
+		Messages: messages,
+	})
+}
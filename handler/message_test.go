@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"testing"
+)
+
+func TestLikeContains(t *testing.T) {
+	setupTestDB(t)
+	for _, content := range []string{"100% sure", "snake_case", `C:\temp`, "plain text"} {
+		message := models.Message{ConversationID: "c", Content: content}
+		if err := db.DB.Table(consts.MessageTable).Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// SQLite has no ILIKE, its LIKE is case insensitive for ASCII already
+	for query, want := range map[string]int64{
+		"%":       1,
+		"_":       1,
+		`\`:       1,
+		`C:\t`:    1,
+		"e%":      0,
+		"0% SURE": 1,
+		"":        4,
+	} {
+		var count int64
+		err := db.DB.Table(consts.MessageTable).Where("content LIKE ? ESCAPE '\\'", likeContains(query)).Count(&count).Error
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if count != want {
+			t.Errorf("%q matched %d messages, want %d", query, count, want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/jwt"
+	"github.com/hewo233/hdu-se/utils/mail"
+	"github.com/hewo233/hdu-se/utils/password"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"time"
+)
+
+// setPassword stores the new password and ends every session of the user
+func setPassword(userID uint, newPassword string) error {
+	hashed, err := password.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", userID).Update("password", hashed).Error; err != nil {
+		return err
+	}
+	return revokeTokens(userID, "")
+}
+
+// sendPasswordReset creates a reset token for the user and mails it, older
+// unused tokens stop working
+func sendPasswordReset(user *models.User) error {
+	token, err := jwt.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Table(consts.PasswordResetTable).Where("user_id = ? AND used_at IS NULL", user.ID).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		reset := models.PasswordReset{
+			UserID:    user.ID,
+			TokenHash: jwt.HashToken(token),
+			ExpiresAt: now.Add(consts.PasswordResetTTL),
+		}
+		return tx.Table(consts.PasswordResetTable).Create(&reset).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mail.Send(&mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"someone asked to reset the password of your account. Use the token below\n" +
+			"to choose a new password:\n\n" +
+			token + "\n\n" +
+			"The token expires in " + consts.PasswordResetTTL.String() + " and works once.\n" +
+			"If it was not you, ignore this mail.\n",
+	})
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPassword POST /auth/password/forgot, the answer is the same whether
+// the email is registered or not
+func ForgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	user := models.UserNew()
+	result := db.DB.Table(consts.UserTable).Where("email = ?", req.Email).Limit(1).Find(user)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to query user",
+		})
+		return
+	}
+
+	if result.RowsAffected > 0 && !user.Disabled {
+		var recent int64
+		err := db.DB.Table(consts.PasswordResetTable).
+			Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-consts.PasswordResetInterval)).
+			Count(&recent).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50121,
+				Result: "Failed to create password reset",
+			})
+			return
+		}
+		if recent == 0 {
+			// sending in the background keeps the response time the same for unknown emails
+			go func(user models.User) {
+				if err := sendPasswordReset(&user); err != nil {
+					log.Println("Failed to send password reset:", err)
+				}
+			}(*user)
+		}
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "If the email is registered, a reset mail was sent",
+	})
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// ResetPassword POST /auth/password/reset
+func ResetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	reset := models.NewPasswordReset()
+	result := db.DB.Table(consts.PasswordResetTable).Where("token_hash = ?", jwt.HashToken(req.Token)).First(reset)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, models.Report{
+				Code:   40015,
+				Result: "Invalid or expired reset token",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50121,
+				Result: "Failed to query password reset",
+			})
+		}
+		return
+	}
+	if reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40015,
+			Result: "Invalid or expired reset token",
+		})
+		return
+	}
+
+	// only one of two concurrent resets wins the token
+	result = db.DB.Table(consts.PasswordResetTable).
+		Where("id = ? AND used_at IS NULL", reset.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50121,
+			Result: "Failed to use password reset",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40015,
+			Result: "Invalid or expired reset token",
+		})
+		return
+	}
+
+	if err := setPassword(reset.UserID, req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50122,
+			Result: "Failed to change password",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Password changed, please log in again",
+	})
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+// ChangePassword PUT /user/password, every session ends and the caller gets
+// tokens for a new one
+func ChangePassword(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters",
+		})
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	user := models.UserNew()
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", userID).First(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to query user",
+		})
+		return
+	}
+	if err := password.CheckHashed(req.CurrentPassword, user.Password); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40016,
+			Result: "Current password is incorrect",
+		})
+		return
+	}
+
+	if err := setPassword(user.ID, req.NewPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50122,
+			Result: "Failed to change password",
+		})
+		return
+	}
+
+	sessionID, err := jwt.RandomToken(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50005,
+			Result: "failed to generate jwt token",
+		})
+		return
+	}
+	tokens, err := issueTokens(user, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50005,
+			Result: "failed to generate jwt token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: tokens,
+	})
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+)
+
+// providerFor returns the backend the bot chats through
+func providerFor(bot *models.Bot) (provider.Provider, error) {
+	return provider.Get(&provider.Config{
+		Kind:    bot.Provider,
+		BaseURL: bot.BaseURL,
+		Model:   bot.Model,
+		APIKey:  bot.APIKey,
+		History: localHistory,
+	})
+}
+
+// GetBotProvider is providerFor for handlers, a misconfigured bot is reported
+func GetBotProvider(c *gin.Context, bot *models.Bot) (provider.Provider, error) {
+	p, err := providerFor(bot)
+	if err != nil {
+		log.Println("Bot", bot.BotID, "has no usable provider:", err)
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50080,
+			Result: "Bot provider is misconfigured",
+		})
+		c.Abort()
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetConversationProvider returns the backend of the bot the conversation was started with
+func GetConversationProvider(c *gin.Context, conversation *models.Conversation) (provider.Provider, error) {
+	bot := models.NewBot()
+	result := db.DB.Table(consts.BotTable).Where("bot_id = ?", conversation.BotID).First(bot)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40401,
+				Result: "Bot not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50040,
+				Result: "Failed to query bot",
+			})
+		}
+		c.Abort()
+		return nil, result.Error
+	}
+	return GetBotProvider(c, bot)
+}
+
+// localHistory serves the stored messages of the current section to
+// providers that keep no conversations themselves
+func localHistory(ctx context.Context, conversationID string) (string, []coze.Message, error) {
+	conversation := models.NewConversation()
+	result := db.DB.WithContext(ctx).Table(consts.ConversationTable).Where("conversation_id = ?", conversationID).First(conversation)
+	if result.Error != nil {
+		return "", nil, result.Error
+	}
+
+	stored, err := loadMessages(conversationID, "", conversation.SectionID)
+	if err != nil {
+		return "", nil, err
+	}
+	messages := make([]coze.Message, 0, len(stored))
+	for _, msg := range stored {
+		if msg.Role == consts.MessageRoleSystem {
+			continue
+		}
+		messages = append(messages, coze.Message{
+			ID:             msg.MessageID,
+			ConversationID: msg.ConversationID,
+			ChatID:         msg.ChatID,
+			Role:           msg.Role,
+			Type:           msg.Type,
+			Content:        msg.Content,
+			ContentType:    msg.ContentType,
+			CreatedAt:      msg.CreatedAt.Unix(),
+			SectionID:      msg.SectionID,
+		})
+	}
+	return conversation.SectionID, messages, nil
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"github.com/hewo233/hdu-se/utils/tools"
+	"gorm.io/gorm/clause"
+	"log"
+	"sync"
+	"time"
+)
+
+// resolving holds the chats whose tool outputs are being submitted, so
+// concurrent polls do not run the same tools twice
+var resolving sync.Map
+
+// claimToolCall stores the call before it runs. It returns false when the call
+// was stored before, record then holds the earlier result.
+func claimToolCall(record *models.ToolCall) bool {
+	result := db.DB.Table(consts.ToolCallTable).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(record)
+	if result.Error != nil {
+		log.Println("Failed to save tool call:", result.Error)
+		return true
+	}
+	if result.RowsAffected > 0 {
+		return true
+	}
+	err := db.DB.Table(consts.ToolCallTable).
+		Where("chat_id = ? AND tool_call_id = ?", record.ChatID, record.ToolCallID).
+		First(record).Error
+	if err != nil {
+		log.Println("Failed to query tool call:", err)
+	}
+	return false
+}
+
+// runRequiredTools runs the tool calls the chat waits for and records every call.
+// A failing tool still produces an output so the bot can tell the user. Calls
+// stored before are not run again, their stored output is used and ran counts
+// only the calls run now.
+func runRequiredTools(ctx context.Context, userID uint, chat *coze.Chat) (outputs []coze.ToolOutput, ran int) {
+	if chat.RequiredAction == nil {
+		return nil, 0
+	}
+
+	for _, toolCall := range chat.RequiredAction.SubmitToolOutputs.ToolCalls {
+		record := models.ToolCall{
+			UserID:         userID,
+			ConversationID: chat.ConversationID,
+			ChatID:         chat.ID,
+			ToolCallID:     toolCall.ID,
+			Name:           toolCall.Function.Name,
+			Arguments:      toolCall.Function.Arguments,
+		}
+		if !claimToolCall(&record) {
+			outputs = append(outputs, coze.ToolOutput{
+				ToolCallID: toolCall.ID,
+				Output:     record.Output,
+			})
+			continue
+		}
+		ran++
+
+		toolCtx, cancel := context.WithTimeout(ctx, consts.ToolTimeout)
+		start := time.Now()
+		output, err := tools.Run(toolCtx, toolCall.Function.Name, &tools.Call{
+			UserID:         userID,
+			ConversationID: chat.ConversationID,
+			Arguments:      json.RawMessage(toolCall.Function.Arguments),
+		})
+		cancel()
+
+		record.DurationMs = time.Since(start).Milliseconds()
+		if err != nil {
+			log.Println("Tool", toolCall.Function.Name, "failed:", err)
+			record.Error = err.Error()
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			output = string(data)
+		}
+		record.Output = output
+		if record.ID != 0 {
+			err := db.DB.Table(consts.ToolCallTable).Where("id = ?", record.ID).Updates(map[string]interface{}{
+				"output":      record.Output,
+				"error":       record.Error,
+				"duration_ms": record.DurationMs,
+			}).Error
+			if err != nil {
+				log.Println("Failed to save tool call:", err)
+			}
+		}
+
+		outputs = append(outputs, coze.ToolOutput{
+			ToolCallID: toolCall.ID,
+			Output:     output,
+		})
+	}
+	return outputs, ran
+}
+
+// resolveRequiredAction runs the tools of a chat in requires_action and submits
+// their outputs, the returned chat is the state after the submission
+func resolveRequiredAction(ctx context.Context, backend provider.Provider, userID uint, chat *coze.Chat) (*coze.Chat, error) {
+	if _, busy := resolving.LoadOrStore(chat.ID, true); busy {
+		return chat, nil
+	}
+	defer resolving.Delete(chat.ID)
+
+	outputs, ran := runRequiredTools(ctx, userID, chat)
+	if len(outputs) == 0 {
+		return nil, errors.New("chat requires an action without tool calls")
+	}
+	if ran == 0 {
+		// the outputs were submitted when the calls ran, the chat has not caught up yet
+		return chat, nil
+	}
+
+	next, err := provider.SubmitToolOutputs(ctx, backend, chat.ConversationID, chat.ID, outputs)
+	if err != nil {
+		return nil, err
+	}
+	saveChatStatus(userID, next)
+	return next, nil
+}
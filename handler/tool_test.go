@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/provider"
+	"github.com/hewo233/hdu-se/utils/tools"
+	"sync/atomic"
+	"testing"
+)
+
+// toolRuns counts the runs of the test tool
+var toolRuns int64
+
+func init() {
+	tools.Register("test_count", func(ctx context.Context, call *tools.Call) (interface{}, error) {
+		return map[string]int64{"run": atomic.AddInt64(&toolRuns, 1)}, nil
+	})
+}
+
+// submitRecorder is a provider that records the tool outputs submitted to it
+type submitRecorder struct {
+	provider.Provider
+	submitted [][]coze.ToolOutput
+}
+
+func (p *submitRecorder) SubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []coze.ToolOutput) (*coze.Chat, error) {
+	p.submitted = append(p.submitted, outputs)
+	return &coze.Chat{ID: chatID, ConversationID: conversationID, Status: coze.ChatStatusInProgress}, nil
+}
+
+func (p *submitRecorder) StreamSubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []coze.ToolOutput) (provider.Stream, error) {
+	return nil, provider.ErrUnsupported
+}
+
+func requiresAction(chatID string, toolCallIDs ...string) *coze.Chat {
+	chat := &coze.Chat{ID: chatID, ConversationID: testConversationID, Status: coze.ChatStatusRequiresAction}
+	chat.RequiredAction = &coze.RequiredAction{Type: "submit_tool_outputs"}
+	for _, id := range toolCallIDs {
+		call := coze.ToolCall{ID: id, Type: "function"}
+		call.Function.Name = "test_count"
+		call.Function.Arguments = "{}"
+		chat.RequiredAction.SubmitToolOutputs.ToolCalls = append(chat.RequiredAction.SubmitToolOutputs.ToolCalls, call)
+	}
+	return chat
+}
+
+func TestResolveRequiredActionRunsToolsOnce(t *testing.T) {
+	setupTestDB(t)
+	backend := &submitRecorder{}
+	runs := atomic.LoadInt64(&toolRuns)
+
+	chat := requiresAction("chat-1", "call-1", "call-2")
+	next, err := resolveRequiredAction(context.Background(), backend, 1, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Status != coze.ChatStatusInProgress || len(backend.submitted) != 1 || len(backend.submitted[0]) != 2 {
+		t.Fatalf("got %+v, submitted %+v", next, backend.submitted)
+	}
+
+	// a poll that still sees the chat waiting for the same calls
+	next, err = resolveRequiredAction(context.Background(), backend, 1, requiresAction("chat-1", "call-1", "call-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Status != coze.ChatStatusRequiresAction || len(backend.submitted) != 1 {
+		t.Fatalf("resolved again: got %+v, submitted %+v", next, backend.submitted)
+	}
+	if got := atomic.LoadInt64(&toolRuns) - runs; got != 2 {
+		t.Fatalf("tools ran %d times", got)
+	}
+
+	var records []models.ToolCall
+	if err := db.DB.Table(consts.ToolCallTable).Order("id").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ToolCallID != "call-1" || records[0].Output == "" || records[1].Output == "" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestResolveRequiredActionReusesStoredOutputs(t *testing.T) {
+	setupTestDB(t)
+	backend := &submitRecorder{}
+	runs := atomic.LoadInt64(&toolRuns)
+
+	stored := models.ToolCall{UserID: 1, ConversationID: testConversationID, ChatID: "chat-2", ToolCallID: "call-1", Name: "test_count", Output: `{"run":0}`}
+	if err := db.DB.Table(consts.ToolCallTable).Create(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolveRequiredAction(context.Background(), backend, 1, requiresAction("chat-2", "call-1", "call-2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&toolRuns) - runs; got != 1 {
+		t.Fatalf("tools ran %d times", got)
+	}
+	if len(backend.submitted) != 1 || len(backend.submitted[0]) != 2 || backend.submitted[0][0].Output != `{"run":0}` {
+		t.Fatalf("submitted %+v", backend.submitted)
+	}
+
+	var count int64
+	db.DB.Table(consts.ToolCallTable).Where("chat_id = ?", "chat-2").Count(&count)
+	if count != 2 {
+		t.Fatalf("got %d records", count)
+	}
+}
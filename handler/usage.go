@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"time"
+)
+
+// recordUsage stores the usage of a finished chat, a chat is only counted once
+func recordUsage(userID uint, chat *coze.Chat) {
+	if chat.Usage == nil {
+		return
+	}
+	usage := models.Usage{
+		UserID:         userID,
+		ConversationID: chat.ConversationID,
+		ChatID:         chat.ID,
+		InputCount:     chat.Usage.InputCount,
+		OutputCount:    chat.Usage.OutputCount,
+		TokenCount:     chat.Usage.TokenCount,
+	}
+	result := db.DB.Table(consts.UsageTable).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "chat_id"}}, DoNothing: true}).
+		Create(&usage)
+	if result.Error != nil {
+		log.Println("Failed to record usage:", result.Error)
+	}
+}
+
+type usageSummary struct {
+	Since       time.Time `json:"since"`
+	InputCount  int64     `json:"input_count"`
+	OutputCount int64     `json:"output_count"`
+	TokenCount  int64     `json:"token_count"`
+	Limit       int64     `json:"limit"` // 0 means unlimited
+}
+
+func (s *usageSummary) exhausted() bool {
+	return s.Limit > 0 && s.TokenCount >= s.Limit
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// getUserQuota returns the quota of the user, falling back to the defaults
+func getUserQuota(userID uint) (*models.Quota, error) {
+	quota := models.NewQuota()
+	result := db.DB.Table(consts.QuotaTable).Where("user_id = ?", userID).First(quota)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return &models.Quota{
+				UserID:        userID,
+				DailyTokens:   consts.DefaultDailyTokenQuota,
+				MonthlyTokens: consts.DefaultMonthlyTokenQuota,
+			}, nil
+		}
+		return nil, result.Error
+	}
+	return quota, nil
+}
+
+func sumUsage(userID uint, since time.Time, limit int64) (*usageSummary, error) {
+	summary := &usageSummary{
+		Since: since,
+		Limit: limit,
+	}
+	result := db.DB.Table(consts.UsageTable).
+		Select("COALESCE(SUM(input_count), 0) AS input_count, COALESCE(SUM(output_count), 0) AS output_count, COALESCE(SUM(token_count), 0) AS token_count").
+		Where("user_id = ? AND created_at >= ?", userID, since).
+		Scan(summary)
+	return summary, result.Error
+}
+
+// getUserUsage returns the daily and monthly usage of the user
+func getUserUsage(userID uint) (*usageSummary, *usageSummary, error) {
+	quota, err := getUserQuota(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	daily, err := sumUsage(userID, startOfDay(now), quota.DailyTokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	monthly, err := sumUsage(userID, startOfMonth(now), quota.MonthlyTokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	return daily, monthly, nil
+}
+
+// CheckUserQuota rejects the request once the user has used up a token quota
+func CheckUserQuota(c *gin.Context, userID uint) error {
+	daily, monthly, err := getUserUsage(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50030,
+			Result: "Failed to query token usage",
+		})
+		c.Abort()
+		return err
+	}
+
+	if daily.exhausted() {
+		c.JSON(http.StatusTooManyRequests, models.Report{
+			Code:   42900,
+			Result: "Daily token quota exhausted",
+		})
+		c.Abort()
+		return errors.New("daily token quota exhausted")
+	}
+	if monthly.exhausted() {
+		c.JSON(http.StatusTooManyRequests, models.Report{
+			Code:   42901,
+			Result: "Monthly token quota exhausted",
+		})
+		c.Abort()
+		return errors.New("monthly token quota exhausted")
+	}
+
+	return nil
+}
+
+type getUsageResponse struct {
+	Daily   *usageSummary `json:"daily"`
+	Monthly *usageSummary `json:"monthly"`
+}
+
+// GetUsage GET /coze/usage
+func GetUsage(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	daily, monthly, err := getUserUsage(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50030,
+			Result: "Failed to query token usage",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code: 20000,
+		Result: getUsageResponse{
+			Daily:   daily,
+			Monthly: monthly,
+		},
+	})
+}
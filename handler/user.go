@@ -7,6 +7,7 @@ import (
 	"github.com/hewo233/hdu-se/shared/consts"
 	"github.com/hewo233/hdu-se/utils/jwt"
 	"github.com/hewo233/hdu-se/utils/password"
+	"log"
 	"net/http"
 	"strconv"
 )
@@ -50,9 +51,10 @@ func (t registerUserRequest) check() bool {
 }
 
 type registerUserResponse struct {
-	ID       uint   `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	ID            uint   `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
 // RegisterUser Register
@@ -106,12 +108,20 @@ func RegisterUser(c *gin.Context) {
 		return
 	}
 
+	// the mail server may be slow, registration does not wait for it
+	go func(user models.User) {
+		if err := sendVerificationMail(&user); err != nil {
+			log.Println("Failed to send verification mail:", err)
+		}
+	}(*user)
+
 	c.JSON(http.StatusOK, models.Report{
 		Code: http.StatusOK,
 		Result: registerUserResponse{
-			ID:       user.ID,
-			Username: user.Username,
-			Email:    user.Email,
+			ID:            user.ID,
+			Username:      user.Username,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
 		},
 	})
 
@@ -123,8 +133,8 @@ type UserLoginRequest struct {
 }
 
 type UserLoginResponse struct {
-	User  models.User `json:"user"`
-	Token string      `json:"token"`
+	User models.User `json:"user"`
+	tokenPair
 }
 
 func UserLogin(c *gin.Context) {
@@ -166,9 +176,25 @@ func UserLogin(c *gin.Context) {
 		return
 	}
 
-	strID := strconv.Itoa(int(user.ID))
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, models.Report{
+			Code:   40303,
+			Result: "user is disabled",
+		})
+		c.Abort()
+		return
+	}
 
-	jwtToken, err := jwt.GenerateJWT(strID, consts.User)
+	sessionID, err := jwt.RandomToken(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50005,
+			Result: "failed to generate jwt token",
+		})
+		c.Abort()
+		return
+	}
+	tokens, err := issueTokens(user, sessionID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.Report{
 			Code:   50005,
@@ -181,8 +207,8 @@ func UserLogin(c *gin.Context) {
 	c.JSON(http.StatusOK, models.Report{
 		Code: 20000,
 		Result: UserLoginResponse{
-			User:  *user,
-			Token: jwtToken,
+			User:      *user,
+			tokenPair: *tokens,
 		},
 	})
 
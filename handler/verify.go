@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/jwt"
+	"github.com/hewo233/hdu-se/utils/mail"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// sendVerificationMail mails a signed link, it is bound to the current email
+// of the user so changing the address invalidates older links
+func sendVerificationMail(user *models.User) error {
+	token, err := jwt.GenerateActionToken(strconv.Itoa(int(user.ID)), user.Email, consts.VerifyEmail, consts.VerifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	link := mail.BaseURL + "/auth/verify?token=" + url.QueryEscape(token)
+	err = mail.Send(&mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"please open the link below to verify your email address:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + consts.VerifyEmailTTL.String() + ".\n",
+	})
+	if err != nil {
+		return err
+	}
+	return db.DB.Table(consts.UserTable).Where("id = ?", user.ID).Update("verification_sent_at", time.Now()).Error
+}
+
+// VerifyEmail GET /auth/verify?token=..., the link from the verification mail
+func VerifyEmail(c *gin.Context) {
+	claims, err := jwt.ParseActionToken(c.Query("token"), consts.VerifyEmail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40013,
+			Result: "Invalid or expired verification link",
+		})
+		return
+	}
+
+	user := models.UserNew()
+	result := db.DB.Table(consts.UserTable).Where("id = ?", claims.Subject).Limit(1).Find(user)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to query user",
+		})
+		return
+	}
+	if result.RowsAffected == 0 || user.Email != claims.Email {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40013,
+			Result: "Invalid or expired verification link",
+		})
+		return
+	}
+
+	if !user.EmailVerified {
+		if err := db.DB.Table(consts.UserTable).Where("id = ?", user.ID).Update("email_verified", true).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50111,
+				Result: "Failed to update user",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Email verified",
+	})
+}
+
+// ResendVerification POST /auth/verify/resend
+func ResendVerification(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	user := models.UserNew()
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", userID).First(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50003,
+			Result: "Failed to query user",
+		})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40014,
+			Result: "Email is already verified",
+		})
+		return
+	}
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < consts.VerifyEmailResendInterval {
+		c.JSON(http.StatusTooManyRequests, models.Report{
+			Code:   42902,
+			Result: "Verification mail was sent recently, try again later",
+		})
+		return
+	}
+
+	if err := sendVerificationMail(user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50120,
+			Result: "Failed to send verification mail",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Verification mail sent",
+	})
+}
@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"github.com/hewo233/hdu-se/utils/webhook"
+	"gorm.io/gorm"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type webhookEvent struct {
+	Event          string          `json:"event"`
+	ConversationID string          `json:"conversation_id,omitempty"`
+	ChatID         string          `json:"chat_id,omitempty"`
+	Status         string          `json:"status,omitempty"`
+	Usage          *coze.Usage     `json:"usage,omitempty"`
+	LastError      *coze.LastError `json:"last_error,omitempty"`
+	Timestamp      int64           `json:"timestamp"`
+}
+
+var chatStatusEvents = map[string]string{
+	coze.ChatStatusCompleted:      consts.WebhookEventChatCompleted,
+	coze.ChatStatusFailed:         consts.WebhookEventChatFailed,
+	coze.ChatStatusRequiresAction: consts.WebhookEventChatRequiresAction,
+}
+
+// notifyChatStatus sends the webhooks of the user for a chat that just changed status
+func notifyChatStatus(userID uint, chat *coze.Chat) {
+	event, ok := chatStatusEvents[chat.Status]
+	if !ok {
+		return
+	}
+
+	hooks := []models.Webhook{}
+	result := db.DB.Table(consts.WebhookTable).Where("user_id = ? AND enabled = ?", userID, true).Find(&hooks)
+	if result.Error != nil {
+		log.Println("Failed to query webhooks:", result.Error)
+		return
+	}
+
+	payload, err := json.Marshal(webhookEvent{
+		Event:          event,
+		ConversationID: chat.ConversationID,
+		ChatID:         chat.ID,
+		Status:         chat.Status,
+		Usage:          chat.Usage,
+		LastError:      chat.LastError,
+		Timestamp:      time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println("Failed to encode webhook event:", err)
+		return
+	}
+
+	for i := range hooks {
+		if hooks[i].Wants(event) {
+			go deliverWebhook(&hooks[i], event, payload)
+		}
+	}
+}
+
+// deliverWebhook delivers with retries and logs every attempt
+func deliverWebhook(hook *models.Webhook, event string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	err := webhook.Deliver(ctx, hook.URL, hook.Secret, event, payload, consts.WebhookMaxAttempts, consts.WebhookRetryDelay,
+		func(attempt int, statusCode int, err error) {
+			logDelivery(hook, event, payload, attempt, statusCode, err)
+		})
+	if err != nil {
+		log.Println("Webhook", hook.ID, "delivery failed:", err)
+	}
+}
+
+func logDelivery(hook *models.Webhook, event string, payload []byte, attempt int, statusCode int, err error) *models.WebhookDelivery {
+	delivery := models.WebhookDelivery{
+		WebhookID:  hook.ID,
+		Event:      event,
+		Payload:    string(payload),
+		Attempt:    attempt,
+		StatusCode: statusCode,
+		Success:    err == nil,
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if dbErr := db.DB.Table(consts.DeliveryTable).Create(&delivery).Error; dbErr != nil {
+		log.Println("Failed to save webhook delivery:", dbErr)
+	}
+	return &delivery
+}
+
+// getUserWebhook loads the webhook in the path and checks that it belongs to the user
+func getUserWebhook(c *gin.Context, userID uint) (*models.Webhook, error) {
+	hook := models.NewWebhook()
+	result := db.DB.Table(consts.WebhookTable).Where("id = ? AND user_id = ?", c.Param("id"), userID).First(hook)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, models.Report{
+				Code:   40404,
+				Result: "Webhook not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.Report{
+				Code:   50070,
+				Result: "Failed to query webhook",
+			})
+		}
+		return nil, result.Error
+	}
+	return hook, nil
+}
+
+type createWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events" binding:"omitempty,dive,oneof=chat.completed chat.failed chat.requires_action"`
+}
+
+type createWebhookResponse struct {
+	models.Webhook
+	// Secret is only shown once, it signs every delivery
+	Secret string `json:"secret"`
+}
+
+// CreateWebhook POST /webhook
+func CreateWebhook(c *gin.Context) {
+	var req createWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40000,
+			Result: "Invalid request parameters" + err.Error(),
+		})
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40030,
+			Result: "Webhook URL must be http or https",
+		})
+		return
+	}
+	// host names are checked when a delivery connects
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !webhook.Allowed(ip) {
+		c.JSON(http.StatusBadRequest, models.Report{
+			Code:   40031,
+			Result: "Webhook URL must point to a public address",
+		})
+		return
+	}
+
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50071,
+			Result: "Failed to generate webhook secret",
+		})
+		return
+	}
+
+	hook := models.Webhook{
+		UserID:  userID,
+		URL:     req.URL,
+		Secret:  hex.EncodeToString(secret),
+		Events:  req.Events,
+		Enabled: true,
+	}
+	if err := db.DB.Table(consts.WebhookTable).Create(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50072,
+			Result: "Failed to save webhook to database",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code: 20000,
+		Result: createWebhookResponse{
+			Webhook: hook,
+			Secret:  hook.Secret,
+		},
+	})
+}
+
+// ListWebhooks GET /webhook
+func ListWebhooks(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+
+	hooks := []models.Webhook{}
+	result := db.DB.Table(consts.WebhookTable).Where("user_id = ?", userID).Order("id").Find(&hooks)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50070,
+			Result: "Failed to query webhook",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: hooks,
+	})
+}
+
+// DeleteWebhook DELETE /webhook/:id
+func DeleteWebhook(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	hook, err := getUserWebhook(c, userID)
+	if err != nil {
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.DeliveryTable).Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.WebhookTable).Delete(hook).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50073,
+			Result: "Failed to delete webhook",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: "Webhook deleted",
+	})
+}
+
+// TestWebhook POST /webhook/:id/test, one synchronous delivery of a ping event
+func TestWebhook(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	hook, err := getUserWebhook(c, userID)
+	if err != nil {
+		return
+	}
+
+	payload, err := json.Marshal(webhookEvent{
+		Event:     consts.WebhookEventPing,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50074,
+			Result: "Failed to encode webhook event",
+		})
+		return
+	}
+
+	statusCode, err := webhook.Send(c.Request.Context(), hook.URL, hook.Secret, consts.WebhookEventPing, payload)
+	delivery := logDelivery(hook, consts.WebhookEventPing, payload, 1, statusCode, err)
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: delivery,
+	})
+}
+
+// ListWebhookDeliveries GET /webhook/:id/deliveries, latest first
+func ListWebhookDeliveries(c *gin.Context) {
+	userID, err := GetUserId(c)
+	if err != nil {
+		return
+	}
+	hook, err := getUserWebhook(c, userID)
+	if err != nil {
+		return
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	result := db.DB.Table(consts.DeliveryTable).
+		Where("webhook_id = ?", hook.ID).
+		Order("id DESC").
+		Limit(100).
+		Find(&deliveries)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.Report{
+			Code:   50075,
+			Result: "Failed to query webhook deliveries",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Report{
+		Code:   20000,
+		Result: deliveries,
+	})
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/webhook"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// allowLoopbackWebhooks lets deliveries reach httptest servers
+func allowLoopbackWebhooks(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "webhook")
+	if err := os.WriteFile(path, []byte(`{"allow_networks":["127.0.0.0/8"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	webhook.InitConfig(path)
+	t.Cleanup(func() {
+		empty := filepath.Join(t.TempDir(), "webhook")
+		if err := os.WriteFile(empty, []byte(`{}`), 0o600); err == nil {
+			webhook.InitConfig(empty)
+		}
+	})
+}
+
+func TestDeliverWebhookLogsAttempts(t *testing.T) {
+	setupTestDB(t)
+	allowLoopbackWebhooks(t)
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhook.SignatureHeader) != webhook.Sign("secret", r.Header.Get(webhook.TimestampHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	hook := &models.Webhook{UserID: 1, URL: server.URL, Secret: "secret", Enabled: true}
+	if err := db.DB.Table(consts.WebhookTable).Create(hook).Error; err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhook(hook, consts.WebhookEventChatCompleted, []byte(`{"event":"chat.completed"}`))
+
+	var deliveries []models.WebhookDelivery
+	if err := db.DB.Table(consts.DeliveryTable).Order("id").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("got %d deliveries, want 2", len(deliveries))
+	}
+	first, second := deliveries[0], deliveries[1]
+	if first.WebhookID != hook.ID || first.Attempt != 1 || first.Success || first.StatusCode != http.StatusServiceUnavailable || first.Error == "" {
+		t.Fatalf("unexpected first attempt %+v", first)
+	}
+	if second.Attempt != 2 || !second.Success || second.StatusCode != http.StatusOK || second.Payload != `{"event":"chat.completed"}` {
+		t.Fatalf("unexpected second attempt %+v", second)
+	}
+}
+
+func TestDeliverWebhookRefusedAddress(t *testing.T) {
+	setupTestDB(t)
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	hook := &models.Webhook{UserID: 1, URL: server.URL, Secret: "secret", Enabled: true}
+	if err := db.DB.Table(consts.WebhookTable).Create(hook).Error; err != nil {
+		t.Fatal(err)
+	}
+	// one attempt as TestWebhook makes it, without the retries of deliverWebhook
+	status, err := webhook.Send(t.Context(), hook.URL, hook.Secret, consts.WebhookEventPing, []byte(`{}`))
+	delivery := logDelivery(hook, consts.WebhookEventPing, []byte(`{}`), 1, status, err)
+	if delivery.Success || delivery.Error == "" || hits.Load() != 0 {
+		t.Fatalf("delivery to loopback was not refused: %+v", delivery)
+	}
+
+	var count int64
+	db.DB.Table(consts.DeliveryTable).Where("webhook_id = ? AND success = ?", hook.ID, false).Count(&count)
+	if count != 1 {
+		t.Fatalf("got %d failed deliveries logged, want 1", count)
+	}
+}
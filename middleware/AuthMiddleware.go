@@ -3,6 +3,9 @@ package middleware
 import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
 	myjwt "github.com/hewo233/hdu-se/utils/jwt"
 	"log"
 	"net/http"
@@ -23,9 +26,9 @@ func JWTAuth(audience string) gin.HandlerFunc {
 
 		tokenString = tokenString[len("Bearer "):]
 
-		token, err := jwt.ParseWithClaims(tokenString, &myjwt.Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return myjwt.JWTKey, nil
-		})
+		// only the algorithms of our own keys, never none or HMAC with a public key
+		parser := &jwt.Parser{ValidMethods: myjwt.Keys.ValidMethods()}
+		token, err := parser.ParseWithClaims(tokenString, &myjwt.Claims{}, myjwt.Keys.Keyfunc)
 		if err != nil || !token.Valid {
 			log.Println("Parse token error: ", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -47,7 +50,23 @@ func JWTAuth(audience string) gin.HandlerFunc {
 				return
 			}
 
-			c.Set("id", claims.StandardClaims.Id)
+			// logout revokes the jti, tokens issued before revocation existed are unknown
+			issued := models.NewAccessToken()
+			result := db.DB.Table(consts.AccessTokenTable).Where("jti = ?", claims.Id).First(issued)
+			if result.Error != nil || issued.Revoked {
+				log.Println("Token revoked or unknown:", claims.Id)
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"errno":   40152,
+					"message": "Unauthorized, token revoked",
+				})
+				c.Abort()
+				return
+			}
+
+			c.Set("id", claims.Subject)
+			c.Set("jti", claims.Id)
+			c.Set("sid", claims.SessionID)
+			c.Set("role", claims.Role)
 		}
 	}
 }
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"log"
+	"net/http"
+)
+
+// RequirePermission lets the request through when the role in the token
+// grants the permission, it must run after JWTAuth
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		if !consts.HasPermission(role, permission) {
+			log.Println("Permission denied:", role, permission)
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40350,
+				"message": "Forbidden, permission denied",
+			})
+			c.Abort()
+			return
+		}
+	}
+}
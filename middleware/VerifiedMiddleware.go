@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"log"
+	"net/http"
+)
+
+// RequireVerifiedEmail blocks users who did not verify their email yet, it
+// must run after JWTAuth
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := models.UserNew()
+		result := db.DB.Table(consts.UserTable).Select("email_verified").Where("id = ?", c.GetString("id")).First(user)
+		if result.Error != nil {
+			log.Println("Failed to query user:", result.Error)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50051,
+				"message": "Failed to query user",
+			})
+			c.Abort()
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40351,
+				"message": "Forbidden, email not verified",
+			})
+			c.Abort()
+			return
+		}
+	}
+}
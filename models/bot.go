@@ -0,0 +1,34 @@
+package models
+
+// Bot is a bot users can start conversations with. Provider selects the
+// backend, BaseURL and Model are used by OpenAI compatible bots and APIKey
+// overrides the default Coze token.
+type Bot struct {
+	ID           uint     `gorm:"primaryKey" json:"id"`
+	BotID        string   `gorm:"uniqueIndex;not null" json:"bot_id"`
+	Name         string   `gorm:"not null" json:"name"`
+	Description  string   `json:"description"`
+	Enabled      bool     `gorm:"not null" json:"enabled"`
+	AllowedRoles []string `gorm:"serializer:json" json:"allowed_roles"` // empty means every role
+	Provider     string   `gorm:"not null;default:coze" json:"provider"`
+	BaseURL      string   `json:"base_url,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	APIKey       string   `json:"-"`
+}
+
+func NewBot() *Bot {
+	return &Bot{}
+}
+
+// AllowsRole reports whether users with the role may use the bot
+func (b *Bot) AllowsRole(role string) bool {
+	if len(b.AllowedRoles) == 0 {
+		return true
+	}
+	for _, r := range b.AllowedRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
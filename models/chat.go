@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Chat tracks the status of one Coze chat, a question and its answers
+type Chat struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ChatID         string    `gorm:"not null;uniqueIndex" json:"chat_id"`
+	ConversationID string    `gorm:"not null;index" json:"conversation_id"`
+	UserID         uint      `gorm:"not null;index" json:"user_id"`
+	Status         string    `gorm:"not null" json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func NewChat() *Chat {
+	return &Chat{}
+}
@@ -3,13 +3,25 @@ package models
 import (
 	"log"
 	"os"
+	"time"
 )
 
+// Conversation is a Coze conversation owned by a user, CustomVariables and
+// MetaData are sent with every chat in it. SectionID is the current context
+// section, clearing the context starts a new one.
 type Conversation struct {
-	ID             uint   `gorm:"primaryKey" json:"id"`
-	UserID         uint   `gorm:"not null" json:"user_id"`
-	ConversationID string `gorm:"not null" json:"conversation_id"`
-	Name           string `gorm:"not null" json:"title"`
+	ID              uint              `gorm:"primaryKey" json:"id"`
+	UserID          uint              `gorm:"not null" json:"user_id"`
+	ConversationID  string            `gorm:"not null;uniqueIndex:idx_conversations_conversation_id_unique" json:"conversation_id"`
+	Name            string            `gorm:"not null" json:"title"`
+	BotID           string            `gorm:"not null;default:''" json:"bot_id"`
+	Archived        bool              `gorm:"not null;default:false" json:"archived"`
+	CustomVariables map[string]string `gorm:"serializer:json" json:"custom_variables"`
+	MetaData        map[string]string `gorm:"serializer:json" json:"meta_data"`
+	SectionID       string            `gorm:"not null;default:''" json:"section_id"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	LastMessageAt   time.Time         `gorm:"index" json:"last_message_at"`
 }
 
 func NewConversation() *Conversation {
@@ -27,5 +39,5 @@ func SetCozeToken(path string) {
 		return
 	}
 	CozeToken = string(data)
-	log.Println("CozeToken:", CozeToken)
+	log.Println("Coze token loaded")
 }
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// File is a file a user uploaded to Coze for use in chat messages
+type File struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	FileID    string    `gorm:"not null;uniqueIndex" json:"file_id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	BotID     string    `gorm:"not null;default:'';index" json:"bot_id"` // the bot whose account holds the file, empty for the default account
+	FileName  string    `gorm:"not null" json:"file_name"`
+	MimeType  string    `gorm:"not null" json:"mime_type"`
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewFile() *File {
+	return &File{}
+}
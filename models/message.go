@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Message is the local copy of a message in a Coze conversation
+type Message struct {
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	ConversationID    string     `gorm:"not null;index" json:"conversation_id"`
+	ChatID            string     `gorm:"index" json:"chat_id"`
+	MessageID         string     `gorm:"index" json:"message_id"` // Coze message id, empty for questions sent by us
+	SectionID         string     `gorm:"index" json:"section_id"`
+	Role              string     `gorm:"not null" json:"role"`
+	Type              string     `json:"type"`
+	ContentType       string     `json:"content_type"`
+	Content           string     `gorm:"type:text" json:"content"`
+	InputCount        int        `json:"input_count"`
+	OutputCount       int        `json:"output_count"`
+	TokenCount        int        `json:"token_count"`
+	CreatedAt         time.Time  `gorm:"index" json:"created_at"`
+	UpstreamCreatedAt *time.Time `json:"upstream_created_at,omitempty"` // as reported by the provider, whole seconds
+}
+
+func NewMessage() *Message {
+	return &Message{}
+}
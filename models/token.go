@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// AccessToken is an issued access token keyed on its jti, JWTAuth rejects
+// tokens that are unknown or revoked. A session is one login and the
+// tokens refreshed from it.
+type AccessToken struct {
+	JTI       string    `gorm:"primaryKey" json:"jti"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	SessionID string    `gorm:"not null;index" json:"session_id"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	Revoked   bool      `gorm:"not null;default:false" json:"revoked"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewAccessToken() *AccessToken {
+	return &AccessToken{}
+}
+
+// RefreshToken is stored as a SHA-256 hash and can be used once, using it
+// again revokes the whole session
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	SessionID string     `gorm:"not null;index" json:"session_id"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	Revoked   bool       `gorm:"not null;default:false" json:"revoked"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func NewRefreshToken() *RefreshToken {
+	return &RefreshToken{}
+}
+
+// PasswordReset is a single use token mailed by POST /auth/password/forgot,
+// stored as a SHA-256 hash like refresh tokens
+type PasswordReset struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func NewPasswordReset() *PasswordReset {
+	return &PasswordReset{}
+}
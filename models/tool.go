@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// ToolCall is the audit record of a tool the server ran for a bot
+type ToolCall struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserID         uint      `gorm:"not null;index" json:"user_id"`
+	ConversationID string    `gorm:"not null;index" json:"conversation_id"`
+	ChatID         string    `gorm:"not null;index;uniqueIndex:idx_tool_calls_chat_id_tool_call_id" json:"chat_id"`
+	ToolCallID     string    `gorm:"not null;uniqueIndex:idx_tool_calls_chat_id_tool_call_id" json:"tool_call_id"`
+	Name           string    `gorm:"not null" json:"name"`
+	Arguments      string    `gorm:"type:text" json:"arguments"`
+	Output         string    `gorm:"type:text" json:"output"`
+	Error          string    `json:"error"`
+	DurationMs     int64     `json:"duration_ms"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func NewToolCall() *ToolCall {
+	return &ToolCall{}
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Usage is the token usage of one finished chat
+type Usage struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserID         uint      `gorm:"not null;index" json:"user_id"`
+	ConversationID string    `gorm:"not null;index" json:"conversation_id"`
+	ChatID         string    `gorm:"not null;uniqueIndex" json:"chat_id"`
+	InputCount     int       `json:"input_count"`
+	OutputCount    int       `json:"output_count"`
+	TokenCount     int       `json:"token_count"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+}
+
+func NewUsage() *Usage {
+	return &Usage{}
+}
+
+// Quota overrides the default token quotas for one user, 0 means unlimited
+type Quota struct {
+	UserID        uint  `gorm:"primaryKey" json:"user_id"`
+	DailyTokens   int64 `gorm:"not null;default:0" json:"daily_tokens"`
+	MonthlyTokens int64 `gorm:"not null;default:0" json:"monthly_tokens"`
+}
+
+func NewQuota() *Quota {
+	return &Quota{}
+}
@@ -1,11 +1,17 @@
 package models
 
+import "time"
+
 type User struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	Username string `gorm:"not null" json:"username"`
-	Email    string `gorm:"unique;not null" json:"email"`
-	Password string `gorm:"not null" json:"-"`
-	Conversations []Conversation `gorm:"foreignKey:UserID" json:"conversations"`
+	ID                 uint           `gorm:"primaryKey" json:"id"`
+	Username           string         `gorm:"not null" json:"username"`
+	Email              string         `gorm:"unique;not null" json:"email"`
+	Password           string         `gorm:"not null" json:"-"`
+	Role               string         `gorm:"not null;default:student" json:"role"`
+	Disabled           bool           `gorm:"not null;default:false" json:"disabled"`
+	EmailVerified      bool           `gorm:"not null;default:false" json:"email_verified"`
+	VerificationSentAt *time.Time     `json:"-"`
+	Conversations      []Conversation `gorm:"foreignKey:UserID" json:"conversations"`
 }
 
 func UserNew() *User {
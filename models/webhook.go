@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Webhook is a URL a user registered to be told about their chats
+type Webhook struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	URL       string    `gorm:"not null" json:"url"`
+	Secret    string    `gorm:"not null" json:"-"`
+	Events    []string  `gorm:"serializer:json" json:"events"` // empty means every event
+	Enabled   bool      `gorm:"not null" json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewWebhook() *Webhook {
+	return &Webhook{}
+}
+
+// Wants reports whether the webhook subscribed to the event
+func (w *Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one delivery attempt of an event
+type WebhookDelivery struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	WebhookID  uint      `gorm:"not null;index" json:"webhook_id"`
+	Event      string    `gorm:"not null" json:"event"`
+	Payload    string    `gorm:"type:text" json:"payload"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+func NewWebhookDelivery() *WebhookDelivery {
+	return &WebhookDelivery{}
+}
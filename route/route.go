@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/hewo233/hdu-se/handler"
 	"github.com/hewo233/hdu-se/middleware"
+	"github.com/hewo233/hdu-se/shared/consts"
 )
 
 var R *gin.Engine
@@ -14,22 +15,62 @@ func InitRoute() {
 	R.Use(middleware.CorsMiddleware())
 
 	R.GET("/ping", handler.Ping)
+	R.GET("/.well-known/jwks.json", handler.JWKS)
 
 	auth := R.Group("/auth")
 	auth.POST("/register", handler.RegisterUser)
 	auth.POST("/login", handler.UserLogin)
+	auth.POST("/refresh", handler.RefreshToken)
+	auth.POST("/logout", middleware.JWTAuth("user"), handler.Logout)
+	auth.GET("/verify", handler.VerifyEmail)
+	auth.POST("/verify/resend", middleware.JWTAuth("user"), handler.ResendVerification)
+	auth.POST("/password/forgot", handler.ForgotPassword)
+	auth.POST("/password/reset", handler.ResetPassword)
 
 	user := R.Group("/user")
 	user.Use(middleware.JWTAuth("user"))
 	user.GET("/:id", handler.GetUserInfoByID)
 	user.GET("", handler.GetUserInfoByEmail)
+	user.PUT("/password", handler.ChangePassword)
 
 	coze := R.Group("/coze")
-	coze.Use(middleware.JWTAuth("user"))
+	coze.Use(middleware.JWTAuth("user"), middleware.RequireVerifiedEmail(), middleware.RequirePermission(consts.PermChat))
 	coze.POST("/conversation", handler.CreateConversation)
 	coze.GET("/conversation", handler.ListConversations)
+	coze.PATCH("/conversation/:id", handler.UpdateConversation)
+	coze.DELETE("/conversation/:id", handler.DeleteConversation)
+	coze.POST("/conversation/:id/clear", handler.ClearConversation)
 	coze.POST("/chat", handler.CreateChat)
+	coze.POST("/chat/stream", handler.StreamChat)
+	coze.POST("/chat/wait", handler.WaitChat)
+	coze.POST("/chat/cancel", handler.CancelChat)
 	coze.GET("/chat", handler.RetrieveConversation)
 	coze.GET("/chat/message", handler.ChatMessageList)
 	coze.GET("/conversation/message", handler.ConversationMessageList)
+	coze.GET("/conversation/history", handler.MessageHistory)
+	coze.GET("/conversation/export", handler.ExportAllConversations)
+	coze.GET("/conversation/:id/export", handler.ExportConversation)
+	coze.GET("/usage", handler.GetUsage)
+	coze.GET("/bot", handler.ListBots)
+	coze.POST("/file", handler.UploadFile)
+
+	hook := R.Group("/webhook")
+	hook.Use(middleware.JWTAuth("user"), middleware.RequirePermission(consts.PermWebhook))
+	hook.POST("", handler.CreateWebhook)
+	hook.GET("", handler.ListWebhooks)
+	hook.DELETE("/:id", handler.DeleteWebhook)
+	hook.POST("/:id/test", handler.TestWebhook)
+	hook.GET("/:id/deliveries", handler.ListWebhookDeliveries)
+
+	admin := R.Group("/admin")
+	admin.Use(middleware.JWTAuth("user"))
+	admin.GET("/bot", middleware.RequirePermission(consts.PermBotManage), handler.AdminListBots)
+	admin.POST("/bot", middleware.RequirePermission(consts.PermBotManage), handler.AdminCreateBot)
+	admin.PUT("/bot/:id", middleware.RequirePermission(consts.PermBotManage), handler.AdminUpdateBot)
+	admin.DELETE("/bot/:id", middleware.RequirePermission(consts.PermBotManage), handler.AdminDeleteBot)
+	admin.GET("/user", middleware.RequirePermission(consts.PermUserRead), handler.AdminListUsers)
+	admin.GET("/user/:id", middleware.RequirePermission(consts.PermUserRead), handler.AdminGetUser)
+	admin.PUT("/user/:id/role", middleware.RequirePermission(consts.PermUserManage), handler.AdminSetUserRole)
+	admin.PUT("/user/:id/disabled", middleware.RequirePermission(consts.PermUserManage), handler.AdminSetUserDisabled)
+	admin.PUT("/user/:id/quota", middleware.RequirePermission(consts.PermQuotaManage), handler.AdminSetUserQuota)
 }
@@ -1,15 +1,94 @@
 package consts
 
+import "time"
+
 const (
 	ApiV1URL = "https://api.coze.cn/v1"
 	ApiV3URL = "https://api.coze.cn/v3"
 
+	// BotID is the default bot, seeded into the bots table on first start
 	BotID = "7563218003241058343"
 
 	CreateConversationURL   = ApiV1URL + "/conversation/create"
 	CreateChatURL           = ApiV3URL + "/chat"
 	RetrieveConversationURL = ApiV3URL + "/chat/retrieve"
 	ChatMessageListURL      = ApiV3URL + "/chat/message/list"
+	CancelChatURL           = ApiV3URL + "/chat/cancel"
+	SubmitToolOutputsURL    = ApiV3URL + "/chat/submit_tool_outputs"
 
 	ConversationMessageListURL = ApiV1URL + "/conversation/message/list"
+	UploadFileURL              = ApiV1URL + "/files/upload"
+	// ClearConversationURL takes the conversation id
+	ClearConversationURL = ApiV1URL + "/conversations/%s/clear"
+
+	// OpenAIChatCompletionsPath is appended to the base URL of OpenAI compatible bots
+	OpenAIChatCompletionsPath = "/chat/completions"
+)
+
+// bot providers
+const (
+	ProviderCoze   = "coze"
+	ProviderOpenAI = "openai"
+	ProviderMock   = "mock"
+)
+
+// Coze v3 chat stream events
+const (
+	StreamEventChatCreated        = "conversation.chat.created"
+	StreamEventChatInProgress     = "conversation.chat.in_progress"
+	StreamEventChatCompleted      = "conversation.chat.completed"
+	StreamEventChatFailed         = "conversation.chat.failed"
+	StreamEventChatRequiresAction = "conversation.chat.requires_action"
+	StreamEventMessageDelta       = "conversation.message.delta"
+	StreamEventMessageCompleted   = "conversation.message.completed"
+	StreamEventError              = "error"
+	StreamEventDone               = "done"
+
+	// StreamEventSummary is sent by us as the last event of a relayed stream
+	StreamEventSummary = "summary"
+)
+
+const (
+	// ChatWaitTimeout is how long POST /coze/chat/wait polls by default
+	ChatWaitTimeout    = 60 * time.Second
+	MaxChatWaitTimeout = 5 * time.Minute
+
+	ChatPollInterval    = 500 * time.Millisecond
+	MaxChatPollInterval = 4 * time.Second
+
+	// MaxToolRounds limits how often one chat may ask us to run tools
+	MaxToolRounds = 5
+	ToolTimeout   = 10 * time.Second
+
+	// MaxSectionPages limits the Coze pages scanned for one page filtered by section
+	MaxSectionPages = 10
+)
+
+const MaxUploadSize = 20 << 20
+
+// AllowedUploadTypes are the MIME types accepted by POST /coze/file
+var AllowedUploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// MessageTypeSection marks a context clear in the local message history
+const (
+	MessageRoleSystem  = "system"
+	MessageTypeSection = "section"
+)
+
+// webhook events
+const (
+	WebhookEventChatCompleted      = "chat.completed"
+	WebhookEventChatFailed         = "chat.failed"
+	WebhookEventChatRequiresAction = "chat.requires_action"
+	WebhookEventPing               = "ping"
+
+	WebhookMaxAttempts = 5
+	WebhookRetryDelay  = 2 * time.Second
 )
@@ -6,7 +6,64 @@ const (
 	OneDay    = 24 * time.Hour
 	ThreeDays = 3 * OneDay
 
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * OneDay
+
 	User = "user"
 
+	// VerifyEmail is the audience of email verification links
+	VerifyEmail               = "verify_email"
+	VerifyEmailTTL            = OneDay
+	VerifyEmailResendInterval = time.Minute
+
+	PasswordResetTTL      = time.Hour
+	PasswordResetInterval = time.Minute
+
 	Issuer = "hdu-se-server"
+
+	// default token quotas for users without a row in the quotas table, 0 means unlimited
+	DefaultDailyTokenQuota   = 200000
+	DefaultMonthlyTokenQuota = 3000000
+
+	DefaultPageSize = 20
+)
+
+// user roles, new users are students
+const (
+	RoleStudent = "student"
+	RoleTeacher = "teacher"
+	RoleAdmin   = "admin"
+)
+
+// permissions checked by middleware.RequirePermission
+const (
+	PermChat        = "chat"
+	PermWebhook     = "webhook"
+	PermUserRead    = "user.read"
+	PermUserManage  = "user.manage"
+	PermBotManage   = "bot.manage"
+	PermQuotaManage = "quota.manage"
 )
+
+// RolePermissions are the permissions granted to each role
+var RolePermissions = map[string][]string{
+	RoleStudent: {PermChat, PermWebhook},
+	RoleTeacher: {PermChat, PermWebhook},
+	RoleAdmin:   {PermChat, PermWebhook, PermUserRead, PermUserManage, PermBotManage, PermQuotaManage},
+}
+
+// HasPermission reports whether the role grants the permission
+func HasPermission(role string, permission string) bool {
+	for _, p := range RolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
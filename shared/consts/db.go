@@ -1,6 +1,18 @@
 package consts
 
 const (
-	UserTable         = "users"
-	ConversationTable = "conversations"
+	UserTable          = "users"
+	ConversationTable  = "conversations"
+	MessageTable       = "messages"
+	UsageTable         = "usages"
+	QuotaTable         = "quotas"
+	BotTable           = "bots"
+	ChatTable          = "chats"
+	FileTable          = "files"
+	ToolCallTable      = "tool_calls"
+	WebhookTable       = "webhooks"
+	DeliveryTable      = "webhook_deliveries"
+	AccessTokenTable   = "access_tokens"
+	RefreshTokenTable  = "refresh_tokens"
+	PasswordResetTable = "password_resets"
 )
@@ -1,7 +1,13 @@
 package consts
 
 const (
-	DBEnvFile     = "./config/db"
-	JWTKeyFile    = "./config/jwt"
-	CozeTokenFile = "./config/coze"
+	DBEnvFile          = "./config/db"
+	JWTKeysDir         = "./config/jwt_keys"
+	LegacyJWTKeyFile   = "./config/jwt" // the HS256 secret before JWTKeysDir, only checked to warn
+	CozeTokenFile      = "./config/coze"
+	AdminEmailsFile    = "./config/admins"
+	MockConfigFile     = "./config/mock"
+	CassetteConfigFile = "./config/cassette"
+	MailConfigFile     = "./config/mail"
+	WebhookConfigFile  = "./config/webhook"
 )
@@ -0,0 +1,422 @@
+package coze
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	CassetteModeRecord = "record"
+	CassetteModeReplay = "replay"
+)
+
+// CassetteConfig is read from consts.CassetteConfigFile. Credentials and user
+// ids are always scrubbed, message contents and uploaded files are redacted
+// unless KeepContent is set.
+type CassetteConfig struct {
+	Mode        string `json:"mode"` // record, replay or empty for live traffic
+	Dir         string `json:"dir"`
+	KeepContent bool   `json:"keep_content"`
+}
+
+// sensitiveHeaders never end up in a cassette
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+type recordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+type recordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+// Interaction is one recorded request and its response
+type Interaction struct {
+	Request    recordedRequest  `json:"request"`
+	Response   recordedResponse `json:"response"`
+	RecordedAt time.Time        `json:"recorded_at"`
+}
+
+func encodeBody(body []byte) (string, bool) {
+	if utf8.Valid(body) {
+		return string(body), false
+	}
+	return base64.StdEncoding.EncodeToString(body), true
+}
+
+func decodeBody(body string, isBase64 bool) ([]byte, error) {
+	if isBase64 {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+const (
+	// scrubbedUserID replaces user ids in recorded requests
+	scrubbedUserID = "user"
+	// redactedContent replaces message contents and file bodies
+	redactedContent = "[redacted]"
+)
+
+// contentFields hold what users and bots wrote
+var contentFields = map[string]bool{"content": true, "reasoning_content": true}
+
+// scrubURL replaces the user_id query parameter, replay scrubs the same way
+// before comparing
+func scrubURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	query := u.Query()
+	if !query.Has("user_id") {
+		return raw
+	}
+	query.Set("user_id", scrubbedUserID)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// scrubBody replaces every user_id field of a JSON body and with redact the
+// contents too. Event streams are scrubbed event by event, other bodies are
+// returned as they are.
+func scrubBody(body []byte, redact bool) []byte {
+	if scrubbed, ok := scrubJSON(body, redact); ok {
+		return scrubbed
+	}
+	lines := bytes.Split(body, []byte("\n"))
+	changed := false
+	for i, line := range lines {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue
+		}
+		if scrubbed, ok := scrubJSON(data, redact); ok {
+			lines[i] = append([]byte("data:"), scrubbed...)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// scrubJSON reports false when the data is not JSON or nothing was replaced
+func scrubJSON(data []byte, redact bool) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || !scrubValue(value, redact) {
+		return nil, false
+	}
+	scrubbed, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	return scrubbed, true
+}
+
+func scrubValue(value interface{}, redact bool) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if s, ok := item.(string); ok {
+				if key == "user_id" {
+					v[key] = scrubbedUserID
+					changed = true
+				} else if redact && contentFields[key] && s != "" {
+					v[key] = redactedContent
+					changed = true
+				}
+				continue
+			}
+			if scrubValue(item, redact) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if scrubValue(item, redact) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// scrub prepares a request or response body for the cassette, uploaded files
+// are dropped unless the contents are kept
+func (c *Cassette) scrub(header http.Header, body []byte) []byte {
+	if c.keepContent {
+		return scrubBody(body, false)
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "multipart/") {
+		return []byte(redactedContent)
+	}
+	return scrubBody(body, true)
+}
+
+func sanitize(header http.Header) http.Header {
+	clean := header.Clone()
+	for _, name := range sensitiveHeaders {
+		clean.Del(name)
+	}
+	return clean
+}
+
+// Cassette records Coze traffic to a directory or replays it from there,
+// one JSON file per interaction
+type Cassette struct {
+	mode        string
+	dir         string
+	keepContent bool
+
+	mu           sync.Mutex
+	seq          int
+	interactions []*Interaction
+	used         []bool
+}
+
+var cassette *Cassette
+
+// InitCassette enables recording or replay when the config file asks for it,
+// it must run before the clients are created
+func InitCassette(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to read cassette config, live traffic only:", err)
+		}
+		return
+	}
+	var cfg CassetteConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatal("Failed to parse cassette config: ", err)
+	}
+	if cfg.Mode == "" {
+		return
+	}
+	cassette, err = NewCassette(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("\033[33mCoze cassette mode:", cfg.Mode, "in", cfg.Dir, "\033[0m")
+}
+
+func NewCassette(cfg *CassetteConfig) (*Cassette, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("coze: cassette directory is empty")
+	}
+	c := &Cassette{mode: cfg.Mode, dir: cfg.Dir, keepContent: cfg.KeepContent}
+	switch c.mode {
+	case CassetteModeRecord:
+		if err := os.MkdirAll(c.dir, 0o755); err != nil {
+			return nil, fmt.Errorf("coze: create cassette directory: %w", err)
+		}
+		// continue the numbering of earlier recordings
+		names, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+		c.seq = len(names)
+	case CassetteModeReplay:
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("coze: unknown cassette mode %q", c.mode)
+	}
+	return c, nil
+}
+
+func (c *Cassette) load() error {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("coze: list cassettes: %w", err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("coze: read cassette: %w", err)
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(data, &interaction); err != nil {
+			return fmt.Errorf("coze: parse cassette %s: %w", name, err)
+		}
+		c.interactions = append(c.interactions, &interaction)
+	}
+	c.used = make([]bool, len(c.interactions))
+	return nil
+}
+
+// Wrap returns a RoundTripper that records through next or replays without it
+func (c *Cassette) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &cassetteTransport{cassette: c, next: next}
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	next     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("coze: read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if t.cassette.mode == CassetteModeReplay {
+		// like a real transport a canceled request gets no response
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return t.cassette.replay(req, body)
+	}
+
+	encoded, isBase64 := encodeBody(t.cassette.scrub(req.Header, body))
+	interaction := &Interaction{
+		Request: recordedRequest{
+			Method:     req.Method,
+			URL:        scrubURL(req.URL.String()),
+			Header:     sanitize(req.Header),
+			Body:       encoded,
+			BodyBase64: isBase64,
+		},
+		RecordedAt: time.Now(),
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction.Response = recordedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     sanitize(resp.Header),
+	}
+	// the response is saved once it was read, streams are passed on as they arrive
+	resp.Body = &recordingBody{body: resp.Body, cassette: t.cassette, interaction: interaction}
+	return resp, nil
+}
+
+// replay serves the first unused interaction with the same method and URL,
+// preferring one with the same request body
+func (c *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	encoded, _ := encodeBody(c.scrub(req.Header, body))
+	requestURL := scrubURL(req.URL.String())
+	match := -1
+	for i, interaction := range c.interactions {
+		if c.used[i] || interaction.Request.Method != req.Method || interaction.Request.URL != requestURL {
+			continue
+		}
+		if interaction.Request.Body == encoded {
+			match = i
+			break
+		}
+		if match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("coze: no recorded response for %s %s", req.Method, req.URL.Path)
+	}
+	c.used[match] = true
+
+	recorded := c.interactions[match].Response
+	data, err := decodeBody(recorded.Body, recorded.BodyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("coze: decode recorded response: %w", err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func (c *Cassette) save(interaction *Interaction) {
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+
+	slug := "request"
+	if u, err := url.Parse(interaction.Request.URL); err == nil {
+		slug = strings.Trim(strings.ReplaceAll(u.Path, "/", "_"), "_")
+	}
+	name := filepath.Join(c.dir, fmt.Sprintf("%04d_%s_%s.json", seq, interaction.Request.Method, slug))
+	data, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		log.Println("Failed to encode cassette:", err)
+		return
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		log.Println("Failed to write cassette:", err)
+	}
+}
+
+// recordingBody copies what the client reads and saves the interaction at
+// the end of the body or when it is closed early
+type recordingBody struct {
+	body        io.ReadCloser
+	cassette    *Cassette
+	interaction *Interaction
+	buf         bytes.Buffer
+	once        sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() {
+		body := b.cassette.scrub(b.interaction.Response.Header, b.buf.Bytes())
+		b.interaction.Response.Body, b.interaction.Response.BodyBase64 = encodeBody(body)
+		b.cassette.save(b.interaction)
+	})
+}
@@ -0,0 +1,175 @@
+package coze
+
+import (
+	"context"
+	"errors"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// the cassette in testdata holds a chat, its retrieval, a streamed chat and
+// two rejected requests, recorded with the contents redacted
+const (
+	testConversationID = "7600000000000000001"
+	testChatID         = "7600000000000000011"
+)
+
+func newReplayClient(t *testing.T) *Client {
+	t.Helper()
+	c, err := NewCassette(&CassetteConfig{Mode: CassetteModeReplay, Dir: "testdata/cassette"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := c.Wrap(nil)
+	return &Client{
+		token:        "test-token",
+		httpClient:   &http.Client{Transport: transport},
+		streamClient: &http.Client{Transport: transport},
+	}
+}
+
+func newTestChatRequest() *ChatRequest {
+	return &ChatRequest{
+		BotID:  "7563218003241058343",
+		UserID: "42",
+		AdditionalMessages: []EnterMessage{{
+			Role:        RoleUser,
+			Type:        MessageTypeQuestion,
+			ContentType: ContentTypeText,
+			Content:     "Hi",
+		}},
+	}
+}
+
+func TestReplayChat(t *testing.T) {
+	cli := newReplayClient(t)
+	ctx := context.Background()
+
+	chat, err := cli.Chat(ctx, testConversationID, newTestChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.ID != testChatID || chat.ConversationID != testConversationID || chat.Status != ChatStatusInProgress {
+		t.Fatalf("unexpected chat %+v", chat)
+	}
+
+	chat, err = cli.RetrieveChat(ctx, testConversationID, testChatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Status != ChatStatusCompleted || chat.CompletedAt != 1767225603 {
+		t.Fatalf("unexpected chat %+v", chat)
+	}
+	if chat.Usage == nil || chat.Usage.TokenCount != 1152 || chat.Usage.InputCount != 972 || chat.Usage.OutputCount != 180 {
+		t.Fatalf("unexpected usage %+v", chat.Usage)
+	}
+}
+
+func TestReplayStreamChat(t *testing.T) {
+	cli := newReplayClient(t)
+
+	stream, err := cli.StreamChat(context.Background(), testConversationID, newTestChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var events []string
+	var answer string
+	var last *StreamEvent
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event.Event)
+		if event.Event == consts.StreamEventMessageDelta {
+			answer += event.Message.Content
+		}
+		last = event
+	}
+
+	want := []string{
+		consts.StreamEventChatCreated,
+		consts.StreamEventMessageDelta,
+		consts.StreamEventMessageDelta,
+		consts.StreamEventMessageCompleted,
+		consts.StreamEventChatCompleted,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("got events %v, want %v", events, want)
+		}
+	}
+	if answer != redactedContent+redactedContent {
+		t.Fatalf("got answer %q", answer)
+	}
+	if last.Chat == nil || last.Chat.Status != ChatStatusCompleted || last.Chat.Usage == nil || last.Chat.Usage.TokenCount != 30 {
+		t.Fatalf("unexpected last event %+v", last)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	cli := newReplayClient(t)
+	ctx := context.Background()
+
+	_, err := cli.RetrieveChat(ctx, testConversationID, "7600000000000000099")
+	var cozeErr *Error
+	if !errors.As(err, &cozeErr) {
+		t.Fatalf("got %v, want *Error", err)
+	}
+	if cozeErr.StatusCode != http.StatusUnauthorized || cozeErr.Code != 4100 || cozeErr.LogID != "20260101000000TESTLOG04" {
+		t.Fatalf("unexpected error %+v", cozeErr)
+	}
+
+	// a rejected stream comes back as plain JSON
+	_, err = cli.StreamChat(ctx, "7600000000000000002", newTestChatRequest())
+	if !errors.As(err, &cozeErr) || cozeErr.Code != 4015 {
+		t.Fatalf("got %v, want *Error with code 4015", err)
+	}
+
+	// nothing recorded, nothing sent
+	_, err = cli.RetrieveChat(ctx, testConversationID, "7600000000000000100")
+	if err == nil {
+		t.Fatal("want an error for an unrecorded request")
+	}
+}
+
+func TestScrub(t *testing.T) {
+	got := scrubURL("https://api.coze.cn/v1/x?conversation_id=1&user_id=42")
+	if got != "https://api.coze.cn/v1/x?conversation_id=1&user_id=user" {
+		t.Fatalf("scrubURL: %s", got)
+	}
+	body := []byte(`{"bot_id":"7563218003241058343","user_id":"42","meta_data":{"user_id":"42"},"additional_messages":[{"content":"Hi"}]}`)
+	if got := string(scrubBody(body, false)); got != `{"additional_messages":[{"content":"Hi"}],"bot_id":"7563218003241058343","meta_data":{"user_id":"user"},"user_id":"user"}` {
+		t.Fatalf("scrubBody: %s", got)
+	}
+	if got := string(scrubBody(body, true)); got != `{"additional_messages":[{"content":"[redacted]"}],"bot_id":"7563218003241058343","meta_data":{"user_id":"user"},"user_id":"user"}` {
+		t.Fatalf("scrubBody with redact: %s", got)
+	}
+	stream := []byte("event:conversation.message.delta\ndata:{\"content\":\"Hel\",\"reasoning_content\":\"hm\"}\n\nevent:done\ndata:\"[DONE]\"\n\n")
+	if got := string(scrubBody(stream, true)); got != "event:conversation.message.delta\ndata:{\"content\":\"[redacted]\",\"reasoning_content\":\"[redacted]\"}\n\nevent:done\ndata:\"[DONE]\"\n\n" {
+		t.Fatalf("scrubBody of a stream: %q", got)
+	}
+	if string(scrubBody([]byte("data: not json"), true)) != "data: not json" {
+		t.Fatal("scrubBody changed a body that is not JSON")
+	}
+
+	upload := http.Header{"Content-Type": {"multipart/form-data; boundary=x"}}
+	c := &Cassette{}
+	if got := string(c.scrub(upload, []byte("--x\r\nfile contents"))); got != redactedContent {
+		t.Fatalf("scrub kept the upload: %q", got)
+	}
+	c.keepContent = true
+	if got := string(c.scrub(upload, []byte("--x\r\nfile contents"))); got != "--x\r\nfile contents" {
+		t.Fatalf("scrub dropped the upload with keep_content: %q", got)
+	}
+}
@@ -0,0 +1,356 @@
+package coze
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeout        = 30 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// Client calls the Coze open API, it is safe for concurrent use
+type Client struct {
+	token string
+
+	// httpClient is used for plain JSON calls and has an overall timeout,
+	// streamClient has none so long answers are not cut off
+	httpClient   *http.Client
+	streamClient *http.Client
+}
+
+var DefaultClient *Client
+
+func InitClient(token string) {
+	DefaultClient = NewClient(token)
+}
+
+func NewClient(token string) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if cassette != nil {
+		roundTripper = cassette.Wrap(transport)
+	}
+
+	return &Client{
+		token: strings.TrimSpace(token),
+		httpClient: &http.Client{
+			Transport: roundTripper,
+			Timeout:   requestTimeout,
+		},
+		streamClient: &http.Client{
+			Transport: roundTripper,
+		},
+	}
+}
+
+type envelope struct {
+	Code   int    `json:"code"`
+	Msg    string `json:"msg"`
+	Detail struct {
+		LogID string `json:"logid"`
+	} `json:"detail"`
+}
+
+func (e *envelope) err(statusCode int) error {
+	if e.Code == 0 {
+		return nil
+	}
+	return &Error{
+		StatusCode: statusCode,
+		Code:       e.Code,
+		Msg:        e.Msg,
+		LogID:      e.Detail.LogID,
+	}
+}
+
+func (cli *Client) newRequest(ctx context.Context, method string, apiURL string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("coze: marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return nil, fmt.Errorf("coze: create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cli.token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// do sends a JSON request, see send
+func (cli *Client) do(ctx context.Context, method string, apiURL string, body interface{}, out interface{}) error {
+	req, err := cli.newRequest(ctx, method, apiURL, body)
+	if err != nil {
+		return err
+	}
+	return cli.send(req, out)
+}
+
+// send sends the request and decodes the whole response body into out,
+// out must embed the fields Coze returns next to data
+func (cli *Client) send(req *http.Request, out interface{}) error {
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("coze: call %s: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("coze: read response: %w", err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("coze: parse response (http %d): %w", resp.StatusCode, err)
+	}
+	if err := env.err(resp.StatusCode); err != nil {
+		return err
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("coze: parse response data: %w", err)
+		}
+	}
+	return nil
+}
+
+func withQuery(apiURL string, query url.Values) string {
+	if len(query) == 0 {
+		return apiURL
+	}
+	return apiURL + "?" + query.Encode()
+}
+
+func (cli *Client) CreateConversation(ctx context.Context, req *CreateConversationRequest) (*Conversation, error) {
+	var resp struct {
+		Data Conversation `json:"data"`
+	}
+	if err := cli.do(ctx, http.MethodPost, consts.CreateConversationURL, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// ClearConversation clears the context of the conversation and returns the new section
+func (cli *Client) ClearConversation(ctx context.Context, conversationID string) (*Section, error) {
+	apiURL := fmt.Sprintf(consts.ClearConversationURL, url.PathEscape(conversationID))
+
+	var resp struct {
+		Data Section `json:"data"`
+	}
+	if err := cli.do(ctx, http.MethodPost, apiURL, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+func (cli *Client) Chat(ctx context.Context, conversationID string, req *ChatRequest) (*Chat, error) {
+	req.Stream = false
+	apiURL := withQuery(consts.CreateChatURL, url.Values{"conversation_id": {conversationID}})
+
+	var resp struct {
+		Data Chat `json:"data"`
+	}
+	if err := cli.do(ctx, http.MethodPost, apiURL, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+func (cli *Client) RetrieveChat(ctx context.Context, conversationID string, chatID string) (*Chat, error) {
+	apiURL := withQuery(consts.RetrieveConversationURL, url.Values{
+		"conversation_id": {conversationID},
+		"chat_id":         {chatID},
+	})
+
+	var resp struct {
+		Data Chat `json:"data"`
+	}
+	if err := cli.do(ctx, http.MethodGet, apiURL, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+func (cli *Client) CancelChat(ctx context.Context, conversationID string, chatID string) (*Chat, error) {
+	var resp struct {
+		Data Chat `json:"data"`
+	}
+	req := &CancelChatRequest{
+		ChatID:         chatID,
+		ConversationID: conversationID,
+	}
+	if err := cli.do(ctx, http.MethodPost, consts.CancelChatURL, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+func (cli *Client) ListChatMessages(ctx context.Context, conversationID string, chatID string) ([]Message, error) {
+	apiURL := withQuery(consts.ChatMessageListURL, url.Values{
+		"conversation_id": {conversationID},
+		"chat_id":         {chatID},
+	})
+
+	var resp struct {
+		Data []Message `json:"data"`
+	}
+	if err := cli.do(ctx, http.MethodGet, apiURL, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// ListConversationMessages returns one page of the conversation history, opts may be nil
+func (cli *Client) ListConversationMessages(ctx context.Context, conversationID string, opts *ListMessagesRequest) (*MessageList, error) {
+	apiURL := withQuery(consts.ConversationMessageListURL, url.Values{"conversation_id": {conversationID}})
+	if opts == nil {
+		opts = &ListMessagesRequest{}
+	}
+
+	var resp struct {
+		Data    []Message `json:"data"`
+		FirstID string    `json:"first_id"`
+		LastID  string    `json:"last_id"`
+		HasMore bool      `json:"has_more"`
+	}
+	if err := cli.do(ctx, http.MethodPost, apiURL, opts, &resp); err != nil {
+		return nil, err
+	}
+	return &MessageList{
+		Messages: resp.Data,
+		FirstID:  resp.FirstID,
+		LastID:   resp.LastID,
+		HasMore:  resp.HasMore,
+	}, nil
+}
+
+// UploadFile uploads a file that can then be referenced by id in object_string messages
+func (cli *Client) UploadFile(ctx context.Context, fileName string, r io.Reader) (*File, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return nil, fmt.Errorf("coze: create form file: %w", err)
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return nil, fmt.Errorf("coze: copy file: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("coze: close form: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, consts.UploadFileURL, &body)
+	if err != nil {
+		return nil, fmt.Errorf("coze: create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cli.token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var resp struct {
+		Data File `json:"data"`
+	}
+	if err := cli.send(req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// StreamChat starts a streaming chat, the caller must Close the returned stream
+func (cli *Client) StreamChat(ctx context.Context, conversationID string, req *ChatRequest) (*ChatStream, error) {
+	req.Stream = true
+	apiURL := withQuery(consts.CreateChatURL, url.Values{"conversation_id": {conversationID}})
+	return cli.openStream(ctx, apiURL, req)
+}
+
+// SubmitToolOutputs answers a chat in requires_action
+func (cli *Client) SubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []ToolOutput) (*Chat, error) {
+	apiURL := withQuery(consts.SubmitToolOutputsURL, url.Values{
+		"conversation_id": {conversationID},
+		"chat_id":         {chatID},
+	})
+
+	var resp struct {
+		Data Chat `json:"data"`
+	}
+	req := &SubmitToolOutputsRequest{ToolOutputs: outputs}
+	if err := cli.do(ctx, http.MethodPost, apiURL, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// StreamSubmitToolOutputs answers a chat in requires_action and streams the rest of the chat
+func (cli *Client) StreamSubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []ToolOutput) (*ChatStream, error) {
+	apiURL := withQuery(consts.SubmitToolOutputsURL, url.Values{
+		"conversation_id": {conversationID},
+		"chat_id":         {chatID},
+	})
+	req := &SubmitToolOutputsRequest{ToolOutputs: outputs, Stream: true}
+	return cli.openStream(ctx, apiURL, req)
+}
+
+func (cli *Client) openStream(ctx context.Context, apiURL string, body interface{}) (*ChatStream, error) {
+	httpReq, err := cli.newRequest(ctx, http.MethodPost, apiURL, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := cli.streamClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("coze: call %s: %w", httpReq.URL.Path, err)
+	}
+
+	// Coze returns a plain JSON body instead of a stream when the request is rejected
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("coze: read response: %w", err)
+		}
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return nil, fmt.Errorf("coze: parse response (http %d): %w", resp.StatusCode, err)
+		}
+		if err := env.err(resp.StatusCode); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("coze: expected an event stream")
+	}
+
+	return newChatStream(resp.Body), nil
+}
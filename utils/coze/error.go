@@ -0,0 +1,18 @@
+package coze
+
+import "fmt"
+
+// Error is a non-zero code returned by the Coze API
+type Error struct {
+	StatusCode int
+	Code       int
+	Msg        string
+	LogID      string
+}
+
+func (e *Error) Error() string {
+	if e.LogID != "" {
+		return fmt.Sprintf("coze: code %d: %s (logid %s)", e.Code, e.Msg, e.LogID)
+	}
+	return fmt.Sprintf("coze: code %d: %s", e.Code, e.Msg)
+}
@@ -0,0 +1,95 @@
+package coze
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"io"
+	"strings"
+)
+
+// StreamEvent is one event of a streaming chat, Chat or Message is set
+// depending on the event type
+type StreamEvent struct {
+	Event   string
+	Chat    *Chat
+	Message *Message
+}
+
+type ChatStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+func newChatStream(body io.ReadCloser) *ChatStream {
+	return &ChatStream{
+		body:   body,
+		reader: bufio.NewReader(body),
+	}
+}
+
+func (s *ChatStream) Close() error {
+	return s.body.Close()
+}
+
+// Recv returns the next event, io.EOF once Coze sends done.
+// An error event from Coze is returned as *Error.
+func (s *ChatStream) Recv() (*StreamEvent, error) {
+	for {
+		event, data, err := s.readEvent()
+		if err != nil {
+			return nil, err
+		}
+
+		switch event {
+		case consts.StreamEventDone:
+			return nil, io.EOF
+		case consts.StreamEventError:
+			var env envelope
+			if err := json.Unmarshal([]byte(data), &env); err != nil {
+				return nil, fmt.Errorf("coze: parse error event: %w", err)
+			}
+			return nil, &Error{Code: env.Code, Msg: env.Msg, LogID: env.Detail.LogID}
+		case consts.StreamEventChatCreated, consts.StreamEventChatInProgress,
+			consts.StreamEventChatCompleted, consts.StreamEventChatFailed,
+			consts.StreamEventChatRequiresAction:
+			var chat Chat
+			if err := json.Unmarshal([]byte(data), &chat); err != nil {
+				return nil, fmt.Errorf("coze: parse %s event: %w", event, err)
+			}
+			return &StreamEvent{Event: event, Chat: &chat}, nil
+		case consts.StreamEventMessageDelta, consts.StreamEventMessageCompleted:
+			var msg Message
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				return nil, fmt.Errorf("coze: parse %s event: %w", event, err)
+			}
+			return &StreamEvent{Event: event, Message: &msg}, nil
+		}
+		// ignore events we do not know about
+	}
+}
+
+// readEvent reads one server-sent event from the stream
+func (s *ChatStream) readEvent() (string, string, error) {
+	var event string
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		if line == "" || err != nil {
+			if event != "" || len(data) > 0 {
+				return event, strings.Join(data, "\n"), nil
+			}
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+}
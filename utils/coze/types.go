@@ -0,0 +1,165 @@
+package coze
+
+const (
+	ChatStatusCreated        = "created"
+	ChatStatusInProgress     = "in_progress"
+	ChatStatusCompleted      = "completed"
+	ChatStatusFailed         = "failed"
+	ChatStatusRequiresAction = "requires_action"
+	ChatStatusCanceled       = "canceled"
+
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+
+	MessageTypeQuestion = "question"
+	MessageTypeAnswer   = "answer"
+	MessageTypeFollowUp = "follow_up"
+	MessageTypeVerbose  = "verbose"
+
+	ContentTypeText         = "text"
+	ContentTypeObjectString = "object_string"
+
+	ObjectTypeText  = "text"
+	ObjectTypeImage = "image"
+	ObjectTypeFile  = "file"
+
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+type Usage struct {
+	TokenCount  int `json:"token_count"`
+	OutputCount int `json:"output_count"`
+	InputCount  int `json:"input_count"`
+}
+
+type LastError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type Chat struct {
+	ID             string     `json:"id"`
+	ConversationID string     `json:"conversation_id"`
+	BotID          string     `json:"bot_id"`
+	CreatedAt      int64      `json:"created_at"`
+	CompletedAt    int64      `json:"completed_at,omitempty"`
+	FailedAt       int64      `json:"failed_at,omitempty"`
+	Status         string     `json:"status"`
+	LastError      *LastError `json:"last_error,omitempty"`
+	Usage          *Usage     `json:"usage,omitempty"`
+
+	RequiredAction *RequiredAction `json:"required_action,omitempty"`
+}
+
+// RequiredAction lists the tool calls a chat in requires_action waits for
+type RequiredAction struct {
+	Type              string `json:"type"`
+	SubmitToolOutputs struct {
+		ToolCalls []ToolCall `json:"tool_calls"`
+	} `json:"submit_tool_outputs"`
+}
+
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type ToolOutput struct {
+	ToolCallID string `json:"tool_call_id"`
+	Output     string `json:"output"`
+}
+
+type Message struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	BotID          string `json:"bot_id"`
+	ChatID         string `json:"chat_id"`
+	Role           string `json:"role"`
+	Type           string `json:"type"`
+	Content        string `json:"content"`
+	ContentType    string `json:"content_type"`
+	CreatedAt      int64  `json:"created_at,omitempty"`
+	SectionID      string `json:"section_id,omitempty"`
+}
+
+type Conversation struct {
+	ID            string `json:"id"`
+	CreatedAt     int64  `json:"created_at"`
+	LastSectionID string `json:"last_section_id"`
+}
+
+// Section is a context section of a conversation, clearing the context starts a new one
+type Section struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+}
+
+// EnterMessage is a message sent to Coze in additional_messages
+type EnterMessage struct {
+	Role        string `json:"role"`
+	Type        string `json:"type,omitempty"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+// ObjectItem is one part of an object_string message
+type ObjectItem struct {
+	Type   string `json:"type"`
+	Text   string `json:"text,omitempty"`
+	FileID string `json:"file_id,omitempty"`
+}
+
+// File is a file uploaded to Coze
+type File struct {
+	ID        string `json:"id"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	FileName  string `json:"file_name"`
+}
+
+type CreateConversationRequest struct {
+	BotID    string            `json:"bot_id"`
+	Name     string            `json:"name"`
+	MetaData map[string]string `json:"meta_data,omitempty"`
+}
+
+type ChatRequest struct {
+	BotID              string         `json:"bot_id"`
+	UserID             string         `json:"user_id"`
+	Stream             bool           `json:"stream"`
+	AdditionalMessages []EnterMessage `json:"additional_messages"`
+
+	CustomVariables map[string]string `json:"custom_variables,omitempty"`
+	MetaData        map[string]string `json:"meta_data,omitempty"`
+}
+
+type CancelChatRequest struct {
+	ChatID         string `json:"chat_id"`
+	ConversationID string `json:"conversation_id"`
+}
+
+type ListMessagesRequest struct {
+	Order    string `json:"order,omitempty"`
+	ChatID   string `json:"chat_id,omitempty"`
+	BeforeID string `json:"before_id,omitempty"`
+	AfterID  string `json:"after_id,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+// MessageList is one page of conversation messages
+type MessageList struct {
+	Messages []Message
+	FirstID  string
+	LastID   string
+	HasMore  bool
+}
+
+type SubmitToolOutputsRequest struct {
+	ToolOutputs []ToolOutput `json:"tool_outputs"`
+	Stream      bool         `json:"stream"`
+}
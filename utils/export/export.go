@@ -0,0 +1,192 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatJSON     = "json"
+	FormatHTML     = "html"
+)
+
+// Transcript is the history of one conversation ready to be rendered
+type Transcript struct {
+	ConversationID string    `json:"conversation_id"`
+	Title          string    `json:"title"`
+	BotName        string    `json:"bot_name"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExportedAt     time.Time `json:"exported_at"`
+	Entries        []Entry   `json:"messages"`
+}
+
+type Entry struct {
+	Role      string    `json:"role"`
+	Type      string    `json:"type"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	// Section is set on the entry that marks a context clear
+	Section bool `json:"section,omitempty"`
+}
+
+// ContentType returns the MIME type of the format, empty for unknown formats
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	}
+	return ""
+}
+
+func Render(w io.Writer, format string, t *Transcript) error {
+	switch format {
+	case FormatMarkdown:
+		return Markdown(w, t)
+	case FormatJSON:
+		return JSON(w, t)
+	case FormatHTML:
+		return HTML(w, t)
+	}
+	return fmt.Errorf("export: unknown format %q", format)
+}
+
+// DisplayContent turns the content of a message into readable text,
+// object_string messages list their attachments by file id
+func DisplayContent(contentType string, content string) string {
+	if contentType != coze.ContentTypeObjectString {
+		return content
+	}
+	var items []coze.ObjectItem
+	if err := json.Unmarshal([]byte(content), &items); err != nil {
+		return content
+	}
+	var parts []string
+	for _, item := range items {
+		if item.Type == coze.ObjectTypeText {
+			parts = append(parts, item.Text)
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s: %s]", item.Type, item.FileID))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func JSON(w io.Writer, t *Transcript) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(t)
+}
+
+func speaker(e *Entry, botName string) string {
+	if e.Role == coze.RoleUser {
+		return "User"
+	}
+	if e.Type == coze.MessageTypeFollowUp {
+		return "Suggested follow-up"
+	}
+	if botName != "" {
+		return botName
+	}
+	return "Assistant"
+}
+
+// markdownInline escapes characters that would change the meaning of a one line text
+var markdownInline = strings.NewReplacer(
+	"\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "#", "\\#",
+	"[", "\\[", "]", "\\]", "<", "&lt;", ">", "&gt;", "\n", " ",
+)
+
+var markdownHTML = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// markdownBody keeps the Markdown of a message but escapes raw HTML outside
+// of fenced code blocks, so a viewer never runs markup from the chat
+func markdownBody(content string) string {
+	lines := strings.Split(content, "\n")
+	fenced := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+			continue
+		}
+		if !fenced {
+			lines[i] = markdownHTML.Replace(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Markdown writes the transcript, message bodies are kept as Markdown since
+// the bot answers in Markdown
+func Markdown(w io.Writer, t *Transcript) error {
+	var b strings.Builder
+	title := t.Title
+	if title == "" {
+		title = t.ConversationID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", markdownInline.Replace(title))
+	if t.BotName != "" {
+		fmt.Fprintf(&b, "- Bot: %s\n", markdownInline.Replace(t.BotName))
+	}
+	fmt.Fprintf(&b, "- Conversation: `%s`\n", t.ConversationID)
+	fmt.Fprintf(&b, "- Created: %s\n", t.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Exported: %s\n\n", t.ExportedAt.Format(time.RFC3339))
+
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if e.Section {
+			fmt.Fprintf(&b, "---\n\n*Context cleared at %s*\n\n", e.CreatedAt.Format(time.RFC3339))
+			continue
+		}
+		fmt.Fprintf(&b, "## %s · %s\n\n", markdownInline.Replace(speaker(e, t.BotName)), e.CreatedAt.Format(time.RFC3339))
+		b.WriteString(markdownBody(e.Content))
+		b.WriteString("\n\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"speaker": speaker,
+	"time":    func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>{{if .Title}}{{.Title}}{{else}}{{.ConversationID}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; }
+.meta { color: #666; font-size: 0.9rem; }
+.message { margin: 1rem 0; padding: 0.75rem 1rem; border-radius: 0.5rem; background: #f4f4f5; }
+.message.user { background: #e0f2fe; }
+.message .who { font-weight: bold; }
+.message .content { white-space: pre-wrap; margin-top: 0.5rem; }
+.section { text-align: center; color: #999; margin: 1.5rem 0; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}{{.ConversationID}}{{end}}</h1>
+<p class="meta">{{if .BotName}}Bot: {{.BotName}} · {{end}}Conversation: {{.ConversationID}} · Created: {{time .CreatedAt}} · Exported: {{time .ExportedAt}}</p>
+{{range .Entries}}{{if .Section}}<div class="section">Context cleared at {{time .CreatedAt}}</div>
+{{else}}<div class="message {{.Role}}">
+<div class="who">{{speaker . $.BotName}} <span class="meta">{{time .CreatedAt}}</span></div>
+<div class="content">{{.Content}}</div>
+</div>
+{{end}}{{end}}</body>
+</html>
+`))
+
+func HTML(w io.Writer, t *Transcript) error {
+	return htmlTemplate.Execute(w, t)
+}
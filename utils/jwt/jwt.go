@@ -1,70 +1,96 @@
 package jwt
 
 import (
-	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/hewo233/hdu-se/shared/consts"
-	"log"
-	"os"
-	"strings"
 	"time"
 )
 
-//TODO: Delete this and use config.yaml
+// Claims carry the user id in sub, the role of the user and a unique jti per token
+type Claims struct {
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Email     string `json:"email,omitempty"`
+	jwt.StandardClaims
+}
+
+// RandomToken returns n random bytes as hex
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
 
-var JWTKey []byte
+// HashToken is how refresh tokens are stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-func InitJWTKey() {
-	file, err := os.Open(consts.JWTKeyFile)
+// GenerateJWT issues a short lived access token for the user
+func GenerateJWT(subject string, sessionID string, role string, audience string) (string, *Claims, error) {
+	jti, err := RandomToken(16)
 	if err != nil {
-		log.Fatal("failed to open JWT key file: " + err.Error())
+		return "", nil, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	var jwtKeyString string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "JWTKEY=") {
-			jwtKeyString = strings.TrimPrefix(line, "JWTKey=")
-			break
-		}
-	}
+	nowTime := time.Now()
+	expireTime := nowTime.Add(consts.AccessTokenTTL)
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal("failed to read JWT key file: " + err.Error())
+	claims := &Claims{
+		SessionID: sessionID,
+		Role:      role,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expireTime.Unix(),
+			Audience:  audience,
+			IssuedAt:  nowTime.Unix(),
+			Issuer:    consts.Issuer,
+			Id:        jti,
+			Subject:   subject,
+		},
 	}
 
-	if jwtKeyString == "" {
-		log.Fatal("JWT key in system is empty")
+	ss, err := Keys.Sign(claims)
+	if err != nil {
+		return "", nil, err
 	}
 
-	JWTKey = []byte(jwtKeyString)
-}
-
-type Claims struct {
-	jwt.StandardClaims
+	return ss, claims, nil
 }
 
-func GenerateJWT(id string, audience string) (string, error) {
+// GenerateActionToken signs a token for a link sent by mail, the audience
+// names the action so the token is never accepted as an access token
+func GenerateActionToken(subject string, email string, audience string, ttl time.Duration) (string, error) {
 	nowTime := time.Now()
-	expireTime := nowTime.Add(consts.ThreeDays)
-
 	claims := &Claims{
+		Email: email,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expireTime.Unix(),
+			ExpiresAt: nowTime.Add(ttl).Unix(),
 			Audience:  audience,
 			IssuedAt:  nowTime.Unix(),
 			Issuer:    consts.Issuer,
-			Id:        id,
+			Subject:   subject,
 		},
 	}
+	return Keys.Sign(claims)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString(JWTKey)
+// ParseActionToken verifies the signature, expiry and audience of an action token
+func ParseActionToken(tokenString string, audience string) (*Claims, error) {
+	parser := &jwt.Parser{ValidMethods: Keys.ValidMethods()}
+	claims := &Claims{}
+	token, err := parser.ParseWithClaims(tokenString, claims, Keys.Keyfunc)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return ss, nil
+	if !token.Valid || claims.Audience != audience {
+		return nil, errors.New("jwt: token is not valid for " + audience)
+	}
+	return claims, nil
 }
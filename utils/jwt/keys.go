@@ -0,0 +1,240 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// minRSABits rejects keys too short to be trusted
+const minRSABits = 2048
+
+// Key is one key of the key set, Private is nil for keys that only verify
+// tokens issued before a rotation
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet holds the signing key and every key tokens are still verified with
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+var Keys *KeySet
+
+// InitKeys loads the key set from dir, see docs/jwt.md for the layout.
+// Without keys the server refuses to start, unless allowEphemeral is set
+// for mock mode, then a key that dies with the process is generated.
+func InitKeys(dir string, allowEphemeral bool) {
+	if _, err := os.Stat(consts.LegacyJWTKeyFile); err == nil {
+		log.Println("\033[33m" + consts.LegacyJWTKeyFile + " is no longer read, tokens are signed with the keys in " + dir + "\033[0m")
+	}
+	ks, err := LoadKeySet(dir)
+	if err != nil {
+		log.Fatal("failed to load JWT keys: " + err.Error())
+	}
+	if ks == nil {
+		if !allowEphemeral {
+			log.Fatal("no JWT keys in " + dir + ", see docs/jwt.md")
+		}
+		log.Println("\033[33mNo JWT keys in " + dir + ", using an ephemeral key, tokens die with the process\033[0m")
+		ks, err = EphemeralKeySet()
+		if err != nil {
+			log.Fatal("failed to generate JWT key: " + err.Error())
+		}
+	}
+	Keys = ks
+}
+
+// LoadKeySet returns nil without an error when dir holds no keys
+func LoadKeySet(dir string) (*KeySet, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	ks := &KeySet{keys: make(map[string]*Key)}
+	var private []*Key
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(strings.TrimSuffix(filepath.Base(name), ".pem"), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ks.keys[key.ID] = key
+		if key.Private != nil {
+			private = append(private, key)
+		}
+	}
+
+	current, err := os.ReadFile(filepath.Join(dir, "current"))
+	switch {
+	case err == nil:
+		kid := strings.TrimSpace(string(current))
+		key, ok := ks.keys[kid]
+		if !ok || key.Private == nil {
+			return nil, fmt.Errorf("current kid %q has no private key", kid)
+		}
+		ks.signing = key
+	case errors.Is(err, os.ErrNotExist) && len(private) == 1:
+		ks.signing = private[0]
+	case errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("%d private keys, name the signing one in %s", len(private), filepath.Join(dir, "current"))
+	default:
+		return nil, err
+	}
+	return ks, nil
+}
+
+func EphemeralKeySet() (*KeySet, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := RandomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ID: kid, Method: EdDSA, Private: privateKey, Public: privateKey.Public()}
+	return &KeySet{signing: key, keys: map[string]*Key{kid: key}}, nil
+}
+
+func parseKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = EdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = EdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+	}
+	if rsaKey, ok := key.Public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+		return nil, fmt.Errorf("RSA key shorter than %d bits", minRSABits)
+	}
+	return key, nil
+}
+
+// ValidMethods are the algorithms tokens may be signed with
+func (ks *KeySet) ValidMethods() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), EdDSA.Alg()}
+}
+
+// Keyfunc picks the verification key by kid and rejects tokens whose
+// algorithm is not the one of that key
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("algorithm %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// Sign signs the claims with the current key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.Private)
+}
+
+// JWK is a public key as published in the JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public keys, the signing key first
+func (ks *KeySet) JWKS() *JWKSet {
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		if kid != ks.signing.ID {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Strings(kids)
+	kids = append([]string{ks.signing.ID}, kids...)
+
+	set := &JWKSet{Keys: []JWK{}}
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.Method.Alg()}
+		switch k := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(k)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
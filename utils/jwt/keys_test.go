@@ -0,0 +1,296 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, dir string, kid string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePrivateKey(t *testing.T, dir string, kid string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "PRIVATE KEY", der)
+}
+
+func writePublicKey(t *testing.T, dir string, kid string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "PUBLIC KEY", der)
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func loadKeys(t *testing.T, dir string) *KeySet {
+	t.Helper()
+	ks, err := LoadKeySet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks == nil {
+		t.Fatal("no key set")
+	}
+	return ks
+}
+
+// parse verifies the token the way AuthMiddleware does
+func parse(ks *KeySet, token string) (*Claims, error) {
+	parser := &jwt.Parser{ValidMethods: ks.ValidMethods()}
+	claims := &Claims{}
+	_, err := parser.ParseWithClaims(token, claims, ks.Keyfunc)
+	return claims, err
+}
+
+func testClaims() *Claims {
+	return &Claims{
+		Role: "student",
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "1",
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, key := range map[string]interface{}{
+		"RS256": newRSAKey(t),
+		"EdDSA": newEd25519Key(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writePrivateKey(t, dir, "k1", key)
+			ks := loadKeys(t, dir)
+
+			token, err := ks.Sign(testClaims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := decodeHeader(t, token)
+			if header["alg"] != name || header["kid"] != "k1" {
+				t.Fatalf("unexpected header %v", header)
+			}
+
+			claims, err := parse(ks, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "1" || claims.Role != "student" {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+
+			// a flipped signature byte must not verify
+			parts := strings.Split(token, ".")
+			sig, _ := jwt.DecodeSegment(parts[2])
+			sig[0] ^= 0xff
+			if _, err := parse(ks, parts[0]+"."+parts[1]+"."+jwt.EncodeSegment(sig)); err == nil {
+				t.Fatal("tampered token verified")
+			}
+		})
+	}
+}
+
+func decodeHeader(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+	data, err := jwt.DecodeSegment(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestRejectedAlgorithms(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t)
+	edKey := newEd25519Key(t)
+	writePrivateKey(t, dir, "rsa", rsaKey)
+	writePrivateKey(t, dir, "ed", edKey)
+	if err := os.WriteFile(filepath.Join(dir, "current"), []byte("ed\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ks := loadKeys(t, dir)
+
+	// HS256 keyed with the public key is the classic confusion attack
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	hs.Header["kid"] = "rsa"
+	publicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	token, err := hs.SignedString(publicDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parse(ks, token); err == nil {
+		t.Fatal("HS256 token verified")
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims())
+	none.Header["kid"] = "ed"
+	token, err = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parse(ks, token); err == nil {
+		t.Fatal("unsigned token verified")
+	}
+
+	// signed by the RSA key but naming the Ed25519 kid
+	mismatch := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims())
+	mismatch.Header["kid"] = "ed"
+	token, err = mismatch.SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parse(ks, token); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("got %v, want a kid/alg mismatch", err)
+	}
+
+	unknown := jwt.NewWithClaims(EdDSA, testClaims())
+	unknown.Header["kid"] = "gone"
+	token, err = unknown.SignedString(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parse(ks, token); err == nil {
+		t.Fatal("token with an unknown kid verified")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := newEd25519Key(t)
+	writePrivateKey(t, dir, "old", oldKey)
+	oldToken, err := loadKeys(t, dir).Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old key stays as public key only, the new one signs
+	if err := os.Remove(filepath.Join(dir, "old.pem")); err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, "old", oldKey.Public())
+	writePrivateKey(t, dir, "new", newRSAKey(t))
+	ks := loadKeys(t, dir)
+	if _, err := parse(ks, oldToken); err != nil {
+		t.Fatalf("token of the rotated key: %v", err)
+	}
+	token, err := ks.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := decodeHeader(t, token); header["kid"] != "new" || header["alg"] != "RS256" {
+		t.Fatalf("unexpected header %v", header)
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	if ks, err := LoadKeySet(t.TempDir()); ks != nil || err != nil {
+		t.Fatalf("empty dir: got %v, %v", ks, err)
+	}
+
+	dir := t.TempDir()
+	writePrivateKey(t, dir, "a", newEd25519Key(t))
+	writePrivateKey(t, dir, "b", newEd25519Key(t))
+	if _, err := LoadKeySet(dir); err == nil {
+		t.Fatal("two private keys without current")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "current"), []byte("c"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeySet(dir); err == nil {
+		t.Fatal("current names a missing kid")
+	}
+
+	dir = t.TempDir()
+	short, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePrivateKey(t, dir, "short", short)
+	if _, err := LoadKeySet(dir); err == nil {
+		t.Fatal("1024 bit RSA key accepted")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newRSAKey(t)
+	edKey := newEd25519Key(t)
+	writePrivateKey(t, dir, "b-rsa", rsaKey)
+	writePrivateKey(t, dir, "a-ed", edKey)
+	if err := os.WriteFile(filepath.Join(dir, "current"), []byte("b-rsa"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(loadKeys(t, dir).JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("got %d keys", len(set.Keys))
+	}
+
+	// the signing key comes first
+	rsaJWK, edJWK := set.Keys[0], set.Keys[1]
+	n := base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes())
+	if rsaJWK["kid"] != "b-rsa" || rsaJWK["kty"] != "RSA" || rsaJWK["alg"] != "RS256" || rsaJWK["use"] != "sig" ||
+		rsaJWK["n"] != n || rsaJWK["e"] != "AQAB" {
+		t.Fatalf("unexpected RSA key %v", rsaJWK)
+	}
+	x := base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))
+	if edJWK["kid"] != "a-ed" || edJWK["kty"] != "OKP" || edJWK["crv"] != "Ed25519" || edJWK["alg"] != "EdDSA" || edJWK["x"] != x {
+		t.Fatalf("unexpected Ed25519 key %v", edJWK)
+	}
+	for _, jwk := range set.Keys {
+		if _, ok := jwk["d"]; ok {
+			t.Fatal("private key material in the JWKS")
+		}
+	}
+}
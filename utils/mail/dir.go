@@ -0,0 +1,27 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// DirMailer writes every mail as an .eml file into Dir, for local development
+type DirMailer struct {
+	Dir  string
+	From string
+	seq  atomic.Int64
+}
+
+func (m *DirMailer) Send(msg *Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("mail: create directory: %w", err)
+	}
+	name := fmt.Sprintf("%s_%d.eml", time.Now().Format("20060102T150405.000"), m.seq.Add(1))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0o644)
+}
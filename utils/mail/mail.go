@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	KindSMTP = "smtp"
+	KindDir  = "dir"
+)
+
+// Config is read from consts.MailConfigFile
+type Config struct {
+	Kind     string `json:"kind"` // smtp or dir
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	Dir      string `json:"dir"`
+	// BaseURL is where the links in mails point to
+	BaseURL string `json:"base_url"`
+}
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mails
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var (
+	// Default is set by InitMailer, mails go to ./mail when nothing is configured
+	Default Mailer = &DirMailer{Dir: "./mail", From: "noreply@localhost"}
+	BaseURL        = "http://localhost:8080"
+)
+
+func InitMailer(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to read mail config:", err)
+		}
+		log.Println("\033[33mNo mail server configured, mails are written to ./mail\033[0m")
+		return
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatal("Failed to parse mail config: ", err)
+	}
+	Default, err = New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.BaseURL != "" {
+		BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+}
+
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Kind {
+	case KindSMTP:
+		if cfg.Host == "" || cfg.From == "" {
+			return nil, errors.New("mail: smtp needs host and from")
+		}
+		if cfg.Port == 0 {
+			cfg.Port = 587
+		}
+		return &SMTPMailer{
+			Host:     cfg.Host,
+			Port:     cfg.Port,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		}, nil
+	case KindDir, "":
+		if cfg.Dir == "" {
+			cfg.Dir = "./mail"
+		}
+		if cfg.From == "" {
+			cfg.From = "noreply@localhost"
+		}
+		return &DirMailer{Dir: cfg.Dir, From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("mail: unknown kind %q", cfg.Kind)
+	}
+}
+
+// Send delivers through Default
+func Send(msg *Message) error {
+	return Default.Send(msg)
+}
+
+// format renders the message as RFC 5322 text
+func format(from string, msg *Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// checkHeaders keeps header injection out of the message
+func checkHeaders(msg *Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("mail: line break in header")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package mail
+
+import (
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPMailer sends through a mail server, STARTTLS is used when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+}
@@ -0,0 +1,31 @@
+package provider
+
+import (
+	"context"
+	"github.com/hewo233/hdu-se/utils/coze"
+)
+
+// cozeProvider offers every operation of the Coze client
+type cozeProvider struct {
+	*coze.Client
+}
+
+func Coze(client *coze.Client) Provider {
+	return &cozeProvider{Client: client}
+}
+
+func (p *cozeProvider) StreamChat(ctx context.Context, conversationID string, req *coze.ChatRequest) (Stream, error) {
+	stream, err := p.Client.StreamChat(ctx, conversationID, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (p *cozeProvider) StreamSubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []coze.ToolOutput) (Stream, error) {
+	stream, err := p.Client.StreamSubmitToolOutputs(ctx, conversationID, chatID, outputs)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,508 @@
+package provider
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockReply scripts the answer to questions that contain Match
+type MockReply struct {
+	Match     string   `json:"match"` // empty matches every question
+	Reply     string   `json:"reply"` // {{question}} is replaced by the question
+	FollowUps []string `json:"follow_ups"`
+	Fail      bool     `json:"fail"` // the chat fails instead of answering
+}
+
+// MockConfig is read from consts.MockConfigFile, the first matching reply wins
+type MockConfig struct {
+	Enabled      bool        `json:"enabled"`
+	LatencyMs    int         `json:"latency_ms"`     // time until a chat completes
+	ChunkDelayMs int         `json:"chunk_delay_ms"` // pause between streamed chunks
+	ChunkSize    int         `json:"chunk_size"`     // runes per streamed chunk
+	FailureRate  float64     `json:"failure_rate"`   // share of chats that end failed
+	ErrorRate    float64     `json:"error_rate"`     // share of calls rejected with an API error
+	Seed         int64       `json:"seed"`
+	Replies      []MockReply `json:"replies"`
+}
+
+// mock is set in mock mode and then serves every bot
+var mock *Mock
+
+var (
+	fallbackMock     *Mock
+	fallbackMockOnce sync.Once
+)
+
+// InitMock turns mock mode on when the config file exists and is enabled
+func InitMock(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to read mock config, mock mode disabled:", err)
+		}
+		return
+	}
+	var cfg MockConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatal("Failed to parse mock config: ", err)
+	}
+	if !cfg.Enabled {
+		return
+	}
+	mock = NewMock(&cfg)
+	log.Println("\033[33mMock provider enabled, chats never leave the process\033[0m")
+}
+
+// MockEnabled reports whether mock mode is on
+func MockEnabled() bool {
+	return mock != nil
+}
+
+// defaultMock serves bots with the mock provider outside of mock mode
+func defaultMock() Provider {
+	fallbackMockOnce.Do(func() {
+		fallbackMock = NewMock(&MockConfig{})
+	})
+	return fallbackMock
+}
+
+// Mock answers chats in process with scripted replies. Ids are sequential
+// behind a random prefix per process, so they never repeat ids stored before a
+// restart. With a fixed seed, injected failures hit the same calls on every run.
+type Mock struct {
+	cfg   MockConfig
+	mu    sync.Mutex
+	rand  *rand.Rand
+	nonce string
+	seq   int
+
+	conversations map[string]*mockConversation
+	chats         map[string]*mockChat
+}
+
+type mockConversation struct {
+	sectionID string
+	messages  []coze.Message
+}
+
+type mockChat struct {
+	chat      coze.Chat
+	sectionID string
+	question  string
+	reply     string
+	followUps []string
+	fail      bool
+	readyAt   time.Time
+	messages  []coze.Message
+}
+
+func NewMock(cfg *MockConfig) *Mock {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 8
+	}
+	b := make([]byte, 4)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return &Mock{
+		cfg:           *cfg,
+		rand:          rand.New(rand.NewSource(cfg.Seed)),
+		nonce:         hex.EncodeToString(b),
+		conversations: make(map[string]*mockConversation),
+		chats:         make(map[string]*mockChat),
+	}
+}
+
+// the methods ending in Locked expect m.mu to be held
+
+func (m *Mock) nextIDLocked(kind string) string {
+	m.seq++
+	return fmt.Sprintf("mock-%s-%s-%d", m.nonce, kind, m.seq)
+}
+
+func (m *Mock) rejectLocked() error {
+	if m.cfg.ErrorRate > 0 && m.rand.Float64() < m.cfg.ErrorRate {
+		return &coze.Error{StatusCode: http.StatusInternalServerError, Code: 5000, Msg: "mock: injected error"}
+	}
+	return nil
+}
+
+// conversationLocked returns the conversation, conversations from before a
+// restart are recreated empty
+func (m *Mock) conversationLocked(conversationID string) *mockConversation {
+	conversation, ok := m.conversations[conversationID]
+	if !ok {
+		conversation = &mockConversation{sectionID: m.nextIDLocked("section")}
+		m.conversations[conversationID] = conversation
+	}
+	return conversation
+}
+
+func (m *Mock) chatLocked(chatID string) (*mockChat, error) {
+	state, ok := m.chats[chatID]
+	if !ok {
+		return nil, notFound("chat")
+	}
+	if state.chat.Status == coze.ChatStatusInProgress && !time.Now().Before(state.readyAt) {
+		m.finishLocked(state)
+	}
+	return state, nil
+}
+
+func (m *Mock) CreateConversation(ctx context.Context, req *coze.CreateConversationRequest) (*coze.Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+
+	id := m.nextIDLocked("conversation")
+	conversation := m.conversationLocked(id)
+	return &coze.Conversation{
+		ID:            id,
+		CreatedAt:     time.Now().Unix(),
+		LastSectionID: conversation.sectionID,
+	}, nil
+}
+
+func (m *Mock) ClearConversation(ctx context.Context, conversationID string) (*coze.Section, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+
+	conversation := m.conversationLocked(conversationID)
+	conversation.sectionID = m.nextIDLocked("section")
+	return &coze.Section{
+		ID:             conversation.sectionID,
+		ConversationID: conversationID,
+	}, nil
+}
+
+// script picks the reply for the question
+func (m *Mock) script(question string) (string, []string, bool) {
+	for _, rule := range m.cfg.Replies {
+		if rule.Match == "" || strings.Contains(question, rule.Match) {
+			return strings.ReplaceAll(rule.Reply, "{{question}}", question), rule.FollowUps, rule.Fail
+		}
+	}
+	return "Mock reply to: " + question, nil, false
+}
+
+// startLocked stores the question and registers the chat in progress
+func (m *Mock) startLocked(conversationID string, req *coze.ChatRequest) (*mockChat, error) {
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+
+	conversation := m.conversationLocked(conversationID)
+	state := &mockChat{
+		chat: coze.Chat{
+			ID:             m.nextIDLocked("chat"),
+			ConversationID: conversationID,
+			BotID:          req.BotID,
+			CreatedAt:      time.Now().Unix(),
+			Status:         coze.ChatStatusInProgress,
+		},
+		sectionID: conversation.sectionID,
+		readyAt:   time.Now().Add(time.Duration(m.cfg.LatencyMs) * time.Millisecond),
+	}
+
+	var questions []string
+	for _, msg := range req.AdditionalMessages {
+		content := msg.Content
+		if msg.ContentType == coze.ContentTypeObjectString {
+			content = textOf(content)
+		}
+		if msg.Role == coze.RoleUser {
+			questions = append(questions, content)
+		}
+		conversation.messages = append(conversation.messages, coze.Message{
+			ID:             m.nextIDLocked("message"),
+			ConversationID: conversationID,
+			BotID:          req.BotID,
+			ChatID:         state.chat.ID,
+			Role:           msg.Role,
+			Type:           msg.Type,
+			Content:        msg.Content,
+			ContentType:    msg.ContentType,
+			CreatedAt:      time.Now().Unix(),
+			SectionID:      conversation.sectionID,
+		})
+	}
+	state.question = strings.Join(questions, "\n")
+	state.reply, state.followUps, state.fail = m.script(state.question)
+	if m.cfg.FailureRate > 0 && m.rand.Float64() < m.cfg.FailureRate {
+		state.fail = true
+	}
+
+	m.chats[state.chat.ID] = state
+	return state, nil
+}
+
+// finishLocked completes or fails the chat as scripted
+func (m *Mock) finishLocked(state *mockChat) {
+	if state.chat.Status != coze.ChatStatusInProgress {
+		return
+	}
+	now := time.Now().Unix()
+	if state.fail {
+		state.chat.Status = coze.ChatStatusFailed
+		state.chat.FailedAt = now
+		state.chat.LastError = &coze.LastError{Code: 5001, Msg: "mock: injected failure"}
+		return
+	}
+
+	message := func(msgType string, content string) coze.Message {
+		return coze.Message{
+			ID:             m.nextIDLocked("message"),
+			ConversationID: state.chat.ConversationID,
+			BotID:          state.chat.BotID,
+			ChatID:         state.chat.ID,
+			Role:           coze.RoleAssistant,
+			Type:           msgType,
+			Content:        content,
+			ContentType:    coze.ContentTypeText,
+			CreatedAt:      now,
+			SectionID:      state.sectionID,
+		}
+	}
+	state.messages = append(state.messages, message(coze.MessageTypeAnswer, state.reply))
+	for _, followUp := range state.followUps {
+		state.messages = append(state.messages, message(coze.MessageTypeFollowUp, followUp))
+	}
+	conversation := m.conversationLocked(state.chat.ConversationID)
+	conversation.messages = append(conversation.messages, state.messages...)
+
+	// one token per rune keeps the numbers predictable
+	input := len([]rune(state.question))
+	output := len([]rune(state.reply))
+	state.chat.Status = coze.ChatStatusCompleted
+	state.chat.CompletedAt = now
+	state.chat.Usage = &coze.Usage{
+		InputCount:  input,
+		OutputCount: output,
+		TokenCount:  input + output,
+	}
+}
+
+func (m *Mock) Chat(ctx context.Context, conversationID string, req *coze.ChatRequest) (*coze.Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, err := m.startLocked(conversationID, req)
+	if err != nil {
+		return nil, err
+	}
+	chat := state.chat
+	return &chat, nil
+}
+
+func (m *Mock) RetrieveChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+	state, err := m.chatLocked(chatID)
+	if err != nil {
+		return nil, err
+	}
+	chat := state.chat
+	return &chat, nil
+}
+
+func (m *Mock) CancelChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, err := m.chatLocked(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if state.chat.Status == coze.ChatStatusInProgress {
+		state.chat.Status = coze.ChatStatusCanceled
+	}
+	chat := state.chat
+	return &chat, nil
+}
+
+func (m *Mock) ListChatMessages(ctx context.Context, conversationID string, chatID string) ([]coze.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+	state, err := m.chatLocked(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]coze.Message(nil), state.messages...), nil
+}
+
+func (m *Mock) ListConversationMessages(ctx context.Context, conversationID string, opts *coze.ListMessagesRequest) (*coze.MessageList, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+	conversation := m.conversationLocked(conversationID)
+	return page(append([]coze.Message(nil), conversation.messages...), opts), nil
+}
+
+// UploadFile accepts any file, only its size is kept
+func (m *Mock) UploadFile(ctx context.Context, fileName string, r io.Reader) (*coze.File, error) {
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, fmt.Errorf("mock: read file: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rejectLocked(); err != nil {
+		return nil, err
+	}
+	return &coze.File{
+		ID:        m.nextIDLocked("file"),
+		Bytes:     n,
+		CreatedAt: time.Now().Unix(),
+		FileName:  fileName,
+	}, nil
+}
+
+func (m *Mock) StreamChat(ctx context.Context, conversationID string, req *coze.ChatRequest) (Stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, err := m.startLocked(conversationID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []string
+	if !state.fail {
+		reply := []rune(state.reply)
+		for i := 0; i < len(reply); i += m.cfg.ChunkSize {
+			end := i + m.cfg.ChunkSize
+			if end > len(reply) {
+				end = len(reply)
+			}
+			chunks = append(chunks, string(reply[i:end]))
+		}
+	}
+	return &mockStream{ctx: ctx, mock: m, state: state, chunks: chunks}, nil
+}
+
+// mockStream plays a chat as Coze events, waiting the configured latency
+// before the first chunk and the chunk delay between chunks
+type mockStream struct {
+	ctx     context.Context
+	mock    *Mock
+	state   *mockChat
+	chunks  []string
+	next    int
+	started bool
+	done    bool
+	pending []*coze.StreamEvent
+}
+
+func (s *mockStream) Close() error {
+	s.mock.CancelChat(s.ctx, s.state.chat.ConversationID, s.state.chat.ID)
+	return nil
+}
+
+func (s *mockStream) wait(ms int) error {
+	if ms <= 0 {
+		return s.ctx.Err()
+	}
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return nil
+	}
+}
+
+func (s *mockStream) Recv() (*coze.StreamEvent, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+		if err := s.advance(); err != nil {
+			return nil, err
+		}
+	}
+	event := s.pending[0]
+	s.pending = s.pending[1:]
+	return event, nil
+}
+
+// advance queues the next events of the chat
+func (s *mockStream) advance() error {
+	m := s.mock
+	if !s.started {
+		s.started = true
+		m.mu.Lock()
+		created := s.state.chat
+		m.mu.Unlock()
+		inProgress := created
+		created.Status = coze.ChatStatusCreated
+		s.pending = append(s.pending,
+			&coze.StreamEvent{Event: consts.StreamEventChatCreated, Chat: &created},
+			&coze.StreamEvent{Event: consts.StreamEventChatInProgress, Chat: &inProgress})
+		return nil
+	}
+
+	delay := m.cfg.ChunkDelayMs
+	if s.next == 0 {
+		delay = m.cfg.LatencyMs
+	}
+	if err := s.wait(delay); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.next < len(s.chunks) {
+		delta := coze.Message{
+			ConversationID: s.state.chat.ConversationID,
+			BotID:          s.state.chat.BotID,
+			ChatID:         s.state.chat.ID,
+			Role:           coze.RoleAssistant,
+			Type:           coze.MessageTypeAnswer,
+			Content:        s.chunks[s.next],
+			ContentType:    coze.ContentTypeText,
+			SectionID:      s.state.sectionID,
+		}
+		s.next++
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventMessageDelta, Message: &delta})
+		return nil
+	}
+
+	s.done = true
+	m.finishLocked(s.state)
+	for i := range s.state.messages {
+		message := s.state.messages[i]
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventMessageCompleted, Message: &message})
+	}
+	chat := s.state.chat
+	switch chat.Status {
+	case coze.ChatStatusCompleted:
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventChatCompleted, Chat: &chat})
+	case coze.ChatStatusFailed:
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventChatFailed, Chat: &chat})
+	}
+	return nil
+}
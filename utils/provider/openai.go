@@ -0,0 +1,545 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatRetention is how long a finished chat can still be retrieved
+const chatRetention = time.Hour
+
+// OpenAI talks to an OpenAI compatible chat completions server. The server
+// keeps no conversations, the history comes from the HistoryFunc and the
+// chats live in memory until chatRetention after they finished.
+type OpenAI struct {
+	baseURL    string
+	model      string
+	apiKey     string
+	history    HistoryFunc
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	chats map[string]*openAIChat
+}
+
+func NewOpenAI(cfg *Config) *OpenAI {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 20,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &OpenAI{
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		model:   cfg.Model,
+		apiKey:  strings.TrimSpace(cfg.APIKey),
+		history: cfg.History,
+		// a non streaming answer only has headers once it is complete,
+		// so requests are bounded by their context instead of a timeout
+		httpClient: &http.Client{Transport: transport},
+		chats:      make(map[string]*openAIChat),
+	}
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model         string          `json:"model"`
+	Messages      []openAIMessage `json:"messages"`
+	User          string          `json:"user,omitempty"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+	Error *openAIError `json:"error"`
+}
+
+func (u *openAIUsage) toCoze() *coze.Usage {
+	if u == nil {
+		return nil
+	}
+	return &coze.Usage{
+		InputCount:  u.PromptTokens,
+		OutputCount: u.CompletionTokens,
+		TokenCount:  u.TotalTokens,
+	}
+}
+
+// openAIChat is the state of one chat, guarded by mu of the provider
+type openAIChat struct {
+	chat      coze.Chat
+	sectionID string
+	messages  []coze.Message
+	cancel    context.CancelFunc
+	// finishedAt is set once the chat left in_progress
+	finishedAt time.Time
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func notFound(what string) error {
+	return &coze.Error{StatusCode: http.StatusNotFound, Code: http.StatusNotFound, Msg: what + " not found"}
+}
+
+func (p *OpenAI) CreateConversation(ctx context.Context, req *coze.CreateConversationRequest) (*coze.Conversation, error) {
+	return &coze.Conversation{
+		ID:            newID(),
+		CreatedAt:     time.Now().Unix(),
+		LastSectionID: newID(),
+	}, nil
+}
+
+// ClearConversation starts a new section, the history of the new section is empty
+func (p *OpenAI) ClearConversation(ctx context.Context, conversationID string) (*coze.Section, error) {
+	return &coze.Section{
+		ID:             newID(),
+		ConversationID: conversationID,
+	}, nil
+}
+
+// prompt builds the messages sent to the server from the history and the new messages
+func (p *OpenAI) prompt(ctx context.Context, conversationID string, req *coze.ChatRequest) (string, []openAIMessage, error) {
+	sectionID, history, err := p.history(ctx, conversationID)
+	if err != nil {
+		return "", nil, fmt.Errorf("openai: load history: %w", err)
+	}
+
+	var messages []openAIMessage
+	for _, msg := range append(history, toMessages(req.AdditionalMessages)...) {
+		if msg.Type != "" && msg.Type != coze.MessageTypeQuestion && msg.Type != coze.MessageTypeAnswer {
+			continue
+		}
+		content := msg.Content
+		if msg.ContentType == coze.ContentTypeObjectString {
+			content = textOf(content)
+		}
+		messages = append(messages, openAIMessage{Role: msg.Role, Content: content})
+	}
+	return sectionID, messages, nil
+}
+
+func toMessages(entered []coze.EnterMessage) []coze.Message {
+	messages := make([]coze.Message, 0, len(entered))
+	for _, msg := range entered {
+		messages = append(messages, coze.Message{
+			Role:        msg.Role,
+			Type:        msg.Type,
+			ContentType: msg.ContentType,
+			Content:     msg.Content,
+		})
+	}
+	return messages
+}
+
+// textOf keeps the text parts of an object_string message
+func textOf(content string) string {
+	var items []coze.ObjectItem
+	if err := json.Unmarshal([]byte(content), &items); err != nil {
+		return content
+	}
+	var parts []string
+	for _, item := range items {
+		if item.Type == coze.ObjectTypeText {
+			parts = append(parts, item.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// start registers a new chat in progress
+func (p *OpenAI) start(conversationID string, sectionID string, botID string, cancel context.CancelFunc) *openAIChat {
+	state := &openAIChat{
+		chat: coze.Chat{
+			ID:             newID(),
+			ConversationID: conversationID,
+			BotID:          botID,
+			CreatedAt:      time.Now().Unix(),
+			Status:         coze.ChatStatusInProgress,
+		},
+		sectionID: sectionID,
+		cancel:    cancel,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, old := range p.chats {
+		if !old.finishedAt.IsZero() && time.Since(old.finishedAt) > chatRetention {
+			delete(p.chats, id)
+		}
+	}
+	p.chats[state.chat.ID] = state
+	return state
+}
+
+// finish stores the answer of a chat, a chat canceled meanwhile stays canceled
+func (p *OpenAI) finish(state *openAIChat, messageID string, answer string, usage *coze.Usage, err error) coze.Chat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state.chat.Status != coze.ChatStatusInProgress {
+		return state.chat
+	}
+
+	state.finishedAt = time.Now()
+	now := state.finishedAt.Unix()
+	if err != nil {
+		state.chat.Status = coze.ChatStatusFailed
+		state.chat.FailedAt = now
+		state.chat.LastError = &coze.LastError{Code: http.StatusBadGateway, Msg: err.Error()}
+		var upstream *coze.Error
+		if errors.As(err, &upstream) {
+			state.chat.LastError = &coze.LastError{Code: upstream.Code, Msg: upstream.Msg}
+		}
+		return state.chat
+	}
+
+	state.chat.Status = coze.ChatStatusCompleted
+	state.chat.CompletedAt = now
+	state.chat.Usage = usage
+	state.messages = []coze.Message{p.answer(state, messageID, answer)}
+	return state.chat
+}
+
+func (p *OpenAI) answer(state *openAIChat, id string, content string) coze.Message {
+	return coze.Message{
+		ID:             id,
+		ConversationID: state.chat.ConversationID,
+		BotID:          state.chat.BotID,
+		ChatID:         state.chat.ID,
+		Role:           coze.RoleAssistant,
+		Type:           coze.MessageTypeAnswer,
+		ContentType:    coze.ContentTypeText,
+		Content:        content,
+		CreatedAt:      time.Now().Unix(),
+		SectionID:      state.sectionID,
+	}
+}
+
+func (p *OpenAI) lookup(chatID string) (*openAIChat, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.chats[chatID]
+	if !ok {
+		return nil, notFound("chat")
+	}
+	return state, nil
+}
+
+// post sends a chat completions request, a non 2xx answer is returned as *coze.Error
+func (p *OpenAI) post(ctx context.Context, body *openAIRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("openai: marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+consts.OpenAIChatCompletionsPath, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("openai: create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("openai: call %s: %w", req.URL.Path, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg := resp.Status
+		var failed openAIResponse
+		if data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err == nil && json.Unmarshal(data, &failed) == nil && failed.Error != nil {
+			msg = failed.Error.Message
+		}
+		return nil, &coze.Error{StatusCode: resp.StatusCode, Code: resp.StatusCode, Msg: msg}
+	}
+	return resp, nil
+}
+
+func (p *OpenAI) Chat(ctx context.Context, conversationID string, req *coze.ChatRequest) (*coze.Chat, error) {
+	sectionID, messages, err := p.prompt(ctx, conversationID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the answer outlives the request that asked for it
+	runCtx, cancel := context.WithTimeout(context.Background(), consts.MaxChatWaitTimeout)
+	state := p.start(conversationID, sectionID, req.BotID, cancel)
+	chat := state.chat
+
+	go func() {
+		defer cancel()
+		answer, usage, err := p.complete(runCtx, &openAIRequest{
+			Model:    p.model,
+			Messages: messages,
+			User:     req.UserID,
+		})
+		p.finish(state, newID(), answer, usage, err)
+	}()
+
+	return &chat, nil
+}
+
+func (p *OpenAI) complete(ctx context.Context, body *openAIRequest) (string, *coze.Usage, error) {
+	resp, err := p.post(ctx, body)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	var out openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", nil, fmt.Errorf("openai: parse response: %w", err)
+	}
+	if len(out.Choices) == 0 {
+		return "", nil, errors.New("openai: response without choices")
+	}
+	return out.Choices[0].Message.Content, out.Usage.toCoze(), nil
+}
+
+func (p *OpenAI) RetrieveChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error) {
+	state, err := p.lookup(chatID)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	chat := state.chat
+	return &chat, nil
+}
+
+func (p *OpenAI) CancelChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error) {
+	state, err := p.lookup(chatID)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state.chat.Status == coze.ChatStatusInProgress {
+		state.chat.Status = coze.ChatStatusCanceled
+		state.finishedAt = time.Now()
+		state.cancel()
+	}
+	chat := state.chat
+	return &chat, nil
+}
+
+func (p *OpenAI) ListChatMessages(ctx context.Context, conversationID string, chatID string) ([]coze.Message, error) {
+	state, err := p.lookup(chatID)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]coze.Message(nil), state.messages...), nil
+}
+
+// ListConversationMessages pages through the history of the current section
+func (p *OpenAI) ListConversationMessages(ctx context.Context, conversationID string, opts *coze.ListMessagesRequest) (*coze.MessageList, error) {
+	_, messages, err := p.history(ctx, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("openai: load history: %w", err)
+	}
+
+	return page(messages, opts), nil
+}
+
+func (p *OpenAI) StreamChat(ctx context.Context, conversationID string, req *coze.ChatRequest) (Stream, error) {
+	sectionID, messages, err := p.prompt(ctx, conversationID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	body := &openAIRequest{
+		Model:    p.model,
+		Messages: messages,
+		User:     req.UserID,
+		Stream:   true,
+	}
+	body.StreamOptions = &struct {
+		IncludeUsage bool `json:"include_usage"`
+	}{IncludeUsage: true}
+	resp, err := p.post(streamCtx, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	state := p.start(conversationID, sectionID, req.BotID, cancel)
+	created := state.chat
+	created.Status = coze.ChatStatusCreated
+	inProgress := state.chat
+	return &openAIStream{
+		ctx:       streamCtx,
+		provider:  p,
+		state:     state,
+		body:      resp.Body,
+		reader:    bufio.NewReader(resp.Body),
+		cancel:    cancel,
+		messageID: newID(),
+		pending: []*coze.StreamEvent{
+			{Event: consts.StreamEventChatCreated, Chat: &created},
+			{Event: consts.StreamEventChatInProgress, Chat: &inProgress},
+		},
+	}, nil
+}
+
+// openAIStream translates the chunks of a streamed completion to Coze events
+type openAIStream struct {
+	ctx       context.Context
+	provider  *OpenAI
+	state     *openAIChat
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	cancel    context.CancelFunc
+	messageID string
+
+	pending []*coze.StreamEvent
+	answer  strings.Builder
+	usage   *coze.Usage
+	done    bool
+}
+
+// Close ends the stream, a chat that did not finish yet is canceled
+func (s *openAIStream) Close() error {
+	s.provider.CancelChat(s.ctx, s.state.chat.ConversationID, s.state.chat.ID)
+	s.cancel()
+	return s.body.Close()
+}
+
+func (s *openAIStream) Recv() (*coze.StreamEvent, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return nil, err
+		}
+	}
+	event := s.pending[0]
+	s.pending = s.pending[1:]
+	return event, nil
+}
+
+// next reads one chunk and queues the events it produces
+func (s *openAIStream) next() error {
+	data, err := s.readData()
+	if err == io.EOF || data == "[DONE]" {
+		s.finish(nil)
+		return nil
+	}
+	if err != nil {
+		if s.ctx.Err() != nil {
+			// the client went away
+			s.provider.CancelChat(s.ctx, s.state.chat.ConversationID, s.state.chat.ID)
+		} else {
+			s.provider.finish(s.state, "", "", nil, err)
+		}
+		return fmt.Errorf("openai: read stream: %w", err)
+	}
+
+	var chunk openAIResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return fmt.Errorf("openai: parse stream chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		upstream := &coze.Error{StatusCode: http.StatusOK, Code: http.StatusBadGateway, Msg: chunk.Error.Message}
+		s.finish(upstream)
+		return upstream
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage.toCoze()
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content == "" {
+			continue
+		}
+		s.answer.WriteString(choice.Delta.Content)
+		delta := s.provider.answer(s.state, s.messageID, choice.Delta.Content)
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventMessageDelta, Message: &delta})
+	}
+	return nil
+}
+
+// finish queues the closing events once the completion ended
+func (s *openAIStream) finish(err error) {
+	s.done = true
+	chat := s.provider.finish(s.state, s.messageID, s.answer.String(), s.usage, err)
+	if err != nil {
+		return
+	}
+	if chat.Status == coze.ChatStatusCompleted {
+		completed := s.provider.answer(s.state, s.messageID, s.answer.String())
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventMessageCompleted, Message: &completed})
+		s.pending = append(s.pending, &coze.StreamEvent{Event: consts.StreamEventChatCompleted, Chat: &chat})
+	}
+}
+
+// readData returns the data of the next server-sent event
+func (s *openAIStream) readData() (string, error) {
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+		if line == "" || err != nil {
+			if len(data) > 0 {
+				return strings.Join(data, "\n"), nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+}
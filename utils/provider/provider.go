@@ -0,0 +1,208 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"github.com/hewo233/hdu-se/utils/coze"
+	"io"
+	"sync"
+)
+
+// ErrUnsupported is returned for operations the provider of a bot does not offer
+var ErrUnsupported = errors.New("provider: operation not supported")
+
+// Provider is a chat backend. Coze types are used as the common data model,
+// other backends translate to them.
+type Provider interface {
+	CreateConversation(ctx context.Context, req *coze.CreateConversationRequest) (*coze.Conversation, error)
+	// Chat starts a chat and returns before the answer is ready, poll RetrieveChat
+	Chat(ctx context.Context, conversationID string, req *coze.ChatRequest) (*coze.Chat, error)
+	// StreamChat starts a streaming chat, the caller must Close the returned stream
+	StreamChat(ctx context.Context, conversationID string, req *coze.ChatRequest) (Stream, error)
+	RetrieveChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error)
+	ListChatMessages(ctx context.Context, conversationID string, chatID string) ([]coze.Message, error)
+	ListConversationMessages(ctx context.Context, conversationID string, opts *coze.ListMessagesRequest) (*coze.MessageList, error)
+}
+
+// Stream yields the events of a streaming chat, Recv returns io.EOF at the end
+type Stream interface {
+	Recv() (*coze.StreamEvent, error)
+	io.Closer
+}
+
+// optional operations, use the functions below to call them
+
+type Canceler interface {
+	CancelChat(ctx context.Context, conversationID string, chatID string) (*coze.Chat, error)
+}
+
+type Clearer interface {
+	ClearConversation(ctx context.Context, conversationID string) (*coze.Section, error)
+}
+
+type Uploader interface {
+	UploadFile(ctx context.Context, fileName string, r io.Reader) (*coze.File, error)
+}
+
+type ToolSubmitter interface {
+	SubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []coze.ToolOutput) (*coze.Chat, error)
+	StreamSubmitToolOutputs(ctx context.Context, conversationID string, chatID string, outputs []coze.ToolOutput) (Stream, error)
+}
+
+func CancelChat(ctx context.Context, p Provider, conversationID string, chatID string) (*coze.Chat, error) {
+	canceler, ok := p.(Canceler)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return canceler.CancelChat(ctx, conversationID, chatID)
+}
+
+func ClearConversation(ctx context.Context, p Provider, conversationID string) (*coze.Section, error) {
+	clearer, ok := p.(Clearer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return clearer.ClearConversation(ctx, conversationID)
+}
+
+func SubmitToolOutputs(ctx context.Context, p Provider, conversationID string, chatID string, outputs []coze.ToolOutput) (*coze.Chat, error) {
+	submitter, ok := p.(ToolSubmitter)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return submitter.SubmitToolOutputs(ctx, conversationID, chatID, outputs)
+}
+
+func StreamSubmitToolOutputs(ctx context.Context, p Provider, conversationID string, chatID string, outputs []coze.ToolOutput) (Stream, error) {
+	submitter, ok := p.(ToolSubmitter)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return submitter.StreamSubmitToolOutputs(ctx, conversationID, chatID, outputs)
+}
+
+// SupportsUpload reports whether attachments can be sent to the provider
+func SupportsUpload(p Provider) bool {
+	_, ok := p.(Uploader)
+	return ok
+}
+
+// HistoryFunc returns the current context section of a conversation and
+// its messages in that section, oldest first. Backends without server side
+// conversations build their prompts from it.
+type HistoryFunc func(ctx context.Context, conversationID string) (string, []coze.Message, error)
+
+// Config selects and configures the provider of a bot
+type Config struct {
+	Kind    string
+	BaseURL string
+	Model   string
+	APIKey  string
+	History HistoryFunc
+}
+
+func (cfg *Config) key() string {
+	return cfg.Kind + "\x00" + cfg.BaseURL + "\x00" + cfg.Model + "\x00" + cfg.APIKey
+}
+
+// providers caches one provider per configuration
+var providers sync.Map
+
+// Get returns the provider for the configuration, the Coze provider
+// without an API key uses the default client. In mock mode every bot
+// talks to the mock.
+func Get(cfg *Config) (Provider, error) {
+	if mock != nil {
+		return mock, nil
+	}
+	switch cfg.Kind {
+	case consts.ProviderMock:
+		return defaultMock(), nil
+	case "", consts.ProviderCoze:
+		if cfg.APIKey == "" {
+			return Coze(coze.DefaultClient), nil
+		}
+	case consts.ProviderOpenAI:
+		if cfg.BaseURL == "" || cfg.Model == "" {
+			return nil, errors.New("provider: openai needs a base URL and a model")
+		}
+		if cfg.History == nil {
+			return nil, errors.New("provider: openai needs a history function")
+		}
+	default:
+		return nil, fmt.Errorf("provider: unknown provider %q", cfg.Kind)
+	}
+
+	if p, ok := providers.Load(cfg.key()); ok {
+		return p.(Provider), nil
+	}
+	var p Provider
+	if cfg.Kind == consts.ProviderOpenAI {
+		p = NewOpenAI(cfg)
+	} else {
+		p = Coze(coze.NewClient(cfg.APIKey))
+	}
+	actual, _ := providers.LoadOrStore(cfg.key(), p)
+	return actual.(Provider), nil
+}
+
+func UploadFile(ctx context.Context, p Provider, fileName string, r io.Reader) (*coze.File, error) {
+	uploader, ok := p.(Uploader)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return uploader.UploadFile(ctx, fileName, r)
+}
+
+// Default is the provider used outside of a bot, for example for uploads
+func Default() Provider {
+	if mock != nil {
+		return mock
+	}
+	return Coze(coze.DefaultClient)
+}
+
+// page cuts one page out of a history ordered oldest first, for providers
+// that keep the history themselves
+func page(messages []coze.Message, opts *coze.ListMessagesRequest) *coze.MessageList {
+	if opts == nil {
+		opts = &coze.ListMessagesRequest{}
+	}
+	for i, msg := range messages {
+		if opts.BeforeID != "" && msg.ID == opts.BeforeID {
+			messages = messages[:i]
+			break
+		}
+		if opts.AfterID != "" && msg.ID == opts.AfterID {
+			messages = messages[i+1:]
+			break
+		}
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	list := &coze.MessageList{HasMore: len(messages) > limit}
+	// like Coze the newest messages come first unless asc is asked for
+	if opts.Order == coze.OrderAsc {
+		if len(messages) > limit {
+			messages = messages[:limit]
+		}
+		list.Messages = messages
+	} else {
+		if len(messages) > limit {
+			messages = messages[len(messages)-limit:]
+		}
+		for i := len(messages) - 1; i >= 0; i-- {
+			list.Messages = append(list.Messages, messages[i])
+		}
+	}
+	if len(list.Messages) > 0 {
+		list.FirstID = list.Messages[0].ID
+		list.LastID = list.Messages[len(list.Messages)-1].ID
+	}
+	return list
+}
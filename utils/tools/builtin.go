@@ -0,0 +1,75 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hewo233/hdu-se/db"
+	"github.com/hewo233/hdu-se/models"
+	"github.com/hewo233/hdu-se/shared/consts"
+	"time"
+)
+
+// RegisterBuiltins registers the tools every deployment provides
+func RegisterBuiltins() {
+	Register("get_my_profile", getMyProfile)
+	Register("list_my_conversations", listMyConversations)
+}
+
+type profile struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+func getMyProfile(ctx context.Context, call *Call) (interface{}, error) {
+	user := models.UserNew()
+	result := db.DB.WithContext(ctx).Table(consts.UserTable).Where("id = ?", call.UserID).First(user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return profile{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+	}, nil
+}
+
+type conversationSummary struct {
+	ConversationID string    `json:"conversation_id"`
+	Title          string    `json:"title"`
+	LastMessageAt  time.Time `json:"last_message_at"`
+}
+
+func listMyConversations(ctx context.Context, call *Call) (interface{}, error) {
+	var args struct {
+		Limit int `json:"limit"`
+	}
+	if len(call.Arguments) > 0 {
+		if err := json.Unmarshal(call.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+	if args.Limit <= 0 || args.Limit > consts.DefaultPageSize {
+		args.Limit = consts.DefaultPageSize
+	}
+
+	conversations := []models.Conversation{}
+	result := db.DB.WithContext(ctx).Table(consts.ConversationTable).
+		Where("user_id = ? AND archived = ?", call.UserID, false).
+		Order("last_message_at DESC").
+		Limit(args.Limit).
+		Find(&conversations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	summaries := []conversationSummary{}
+	for _, conversation := range conversations {
+		summaries = append(summaries, conversationSummary{
+			ConversationID: conversation.ConversationID,
+			Title:          conversation.Name,
+			LastMessageAt:  conversation.LastMessageAt,
+		})
+	}
+	return summaries, nil
+}
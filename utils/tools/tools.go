@@ -0,0 +1,72 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Call is one invocation of a tool on behalf of a user
+type Call struct {
+	UserID         uint
+	ConversationID string
+	Arguments      json.RawMessage
+}
+
+// Func runs a tool, the result is sent to the bot as JSON
+type Func func(ctx context.Context, call *Call) (interface{}, error)
+
+type Registry struct {
+	mu    sync.RWMutex
+	tools map[string]Func
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tools: make(map[string]Func),
+	}
+}
+
+// Register adds a tool, the name must match the function name configured on the bot
+func (r *Registry) Register(name string, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tools[name]; ok {
+		panic("tools: tool registered twice: " + name)
+	}
+	r.tools[name] = fn
+}
+
+// Run runs the named tool and returns its JSON encoded result
+func (r *Registry) Run(ctx context.Context, name string, call *Call) (string, error) {
+	r.mu.RLock()
+	fn, ok := r.tools[name]
+	r.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("tools: unknown tool %q", name)
+	}
+
+	result, err := fn(ctx, call)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := result.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("tools: marshal result of %q: %w", name, err)
+	}
+	return string(data), nil
+}
+
+func Register(name string, fn Func) {
+	DefaultRegistry.Register(name, fn)
+}
+
+func Run(ctx context.Context, name string, call *Call) (string, error) {
+	return DefaultRegistry.Run(ctx, name, call)
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Config is read from consts.WebhookConfigFile
+type Config struct {
+	// AllowNetworks are CIDRs that may be delivered to although they are not
+	// public, e.g. "127.0.0.1/32" for a local test receiver
+	AllowNetworks []string `json:"allow_networks"`
+}
+
+var ErrAddressNotAllowed = errors.New("webhook: address is not public")
+
+var allowNetworks []*net.IPNet
+
+// blockedNetworks are not covered by the net.IP helpers
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: invalid network %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func InitConfig(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to read webhook config:", err)
+		}
+		return
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatal("Failed to parse webhook config: ", err)
+	}
+	allowNetworks, err = parseCIDRs(cfg.AllowNetworks)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Allowed reports whether deliveries may connect to ip
+func Allowed(ip net.IP) bool {
+	for _, network := range allowNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl checks the resolved address right before connecting, so
+// neither DNS nor redirects can lead a delivery into the internal network
+func dialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !Allowed(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, host)
+	}
+	return nil
+}
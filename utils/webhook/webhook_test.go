@@ -0,0 +1,230 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// allowLoopback lets deliveries reach httptest servers for the duration of the test
+func allowLoopback(t *testing.T) {
+	t.Helper()
+	networks, err := parseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := allowNetworks
+	allowNetworks = networks
+	t.Cleanup(func() { allowNetworks = old })
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"a":1}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", "1700000000", []byte(`{"a":1}`))
+	if got != "sha256=49f24e537407743fa4a0242bb63b94b9a47ee99cbbe071ccd8a22550ae411686" {
+		t.Fatalf("got %s", got)
+	}
+	if got == Sign("other", "1700000000", []byte(`{"a":1}`)) ||
+		got == Sign("secret", "1700000001", []byte(`{"a":1}`)) ||
+		got == Sign("secret", "1700000000", []byte(`{"a":2}`)) {
+		t.Fatal("signature ignores part of its input")
+	}
+}
+
+func TestSendSigned(t *testing.T) {
+	allowLoopback(t)
+	body := []byte(`{"event":"chat.completed"}`)
+
+	var verified atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(TimestampHeader)
+		if r.Method == http.MethodPost &&
+			r.Header.Get(EventHeader) == "chat.completed" &&
+			r.Header.Get("Content-Type") == "application/json" &&
+			string(got) == string(body) &&
+			r.Header.Get(SignatureHeader) == Sign("secret", timestamp, got) {
+			verified.Store(true)
+		}
+	}))
+	defer server.Close()
+
+	status, err := Send(context.Background(), server.URL, "secret", "chat.completed", body)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("got %d, %v", status, err)
+	}
+	if !verified.Load() {
+		t.Fatal("receiver could not verify the delivery")
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	allowLoopback(t)
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	var attempts []int
+	var statuses []int
+	err := Deliver(context.Background(), server.URL, "secret", "ping", []byte(`{}`), 5, time.Millisecond,
+		func(attempt int, statusCode int, err error) {
+			attempts = append(attempts, attempt)
+			statuses = append(statuses, statusCode)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 3 || len(attempts) != 3 || attempts[2] != 3 {
+		t.Fatalf("got %d hits, attempts %v", hits.Load(), attempts)
+	}
+	if statuses[0] != http.StatusBadGateway || statuses[1] != http.StatusBadGateway || statuses[2] != http.StatusOK {
+		t.Fatalf("got statuses %v", statuses)
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	allowLoopback(t)
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var calls int
+	err := Deliver(context.Background(), server.URL, "secret", "ping", []byte(`{}`), 3, time.Millisecond,
+		func(attempt int, statusCode int, err error) {
+			calls++
+			if err == nil || statusCode != http.StatusInternalServerError {
+				t.Errorf("attempt %d: got %d, %v", attempt, statusCode, err)
+			}
+		})
+	if err == nil {
+		t.Fatal("want an error after the last attempt")
+	}
+	if hits.Load() != 3 || calls != 3 {
+		t.Fatalf("got %d hits and %d calls, want 3", hits.Load(), calls)
+	}
+}
+
+func TestDeliverTimeout(t *testing.T) {
+	allowLoopback(t)
+	old := client.Timeout
+	client.Timeout = 50 * time.Millisecond
+	defer func() { client.Timeout = old }()
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var errs []error
+	err := Deliver(context.Background(), server.URL, "secret", "ping", []byte(`{}`), 3, time.Millisecond,
+		func(attempt int, statusCode int, err error) {
+			errs = append(errs, err)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 || errs[0] == nil || errs[1] != nil {
+		t.Fatalf("got attempts %v, want a timeout and a success", errs)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "224.0.0.1", "::1", "fe80::1", "fc00::1",
+	} {
+		if Allowed(net.ParseIP(addr)) {
+			t.Errorf("%s is allowed", addr)
+		}
+	}
+	for _, addr := range []string{"1.1.1.1", "93.184.216.34", "2606:4700::1111"} {
+		if !Allowed(net.ParseIP(addr)) {
+			t.Errorf("%s is refused", addr)
+		}
+	}
+
+	allowLoopback(t)
+	if !Allowed(net.ParseIP("127.0.0.1")) {
+		t.Fatal("allow_networks is ignored")
+	}
+	if Allowed(net.ParseIP("10.1.2.3")) {
+		t.Fatal("allow_networks allows more than listed")
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	old := allowNetworks
+	defer func() { allowNetworks = old }()
+
+	path := filepath.Join(t.TempDir(), "webhook")
+	if err := os.WriteFile(path, []byte(`{"allow_networks":["10.0.0.0/8"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	InitConfig(path)
+	if !Allowed(net.ParseIP("10.1.2.3")) || Allowed(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("got allow_networks %v", allowNetworks)
+	}
+}
+
+func TestSendRefused(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	// the literal address and a name resolving to it are both checked at dial time
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, url := range []string{server.URL, "http://localhost:" + port} {
+		_, err := Send(context.Background(), url, "secret", "ping", []byte(`{}`))
+		if !errors.Is(err, ErrAddressNotAllowed) {
+			t.Errorf("%s: got %v, want ErrAddressNotAllowed", url, err)
+		}
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("refused deliveries reached the receiver %d times", hits.Load())
+	}
+}
+
+func TestSendRefusedRedirect(t *testing.T) {
+	// only the receiver itself is allowlisted, not the address it redirects to
+	networks, err := parseCIDRs([]string{"127.0.0.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := allowNetworks
+	allowNetworks = networks
+	defer func() { allowNetworks = old }()
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/", http.StatusTemporaryRedirect)
+	}))
+	defer public.Close()
+
+	_, err = Send(context.Background(), public.URL, "secret", "ping", []byte(`{}`))
+	if !errors.Is(err, ErrAddressNotAllowed) {
+		t.Fatalf("got %v, want ErrAddressNotAllowed", err)
+	}
+}